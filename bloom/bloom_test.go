@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math/rand"
 	"testing"
+	"time"
 )
 
 func TestBloom(t *testing.T) {
@@ -35,3 +36,156 @@ func TestBloom2(t *testing.T) {
 		}
 	}
 }
+
+func TestBlockedBloom(t *testing.T) {
+	filter := NewBlockedBloomFilter(1024, 0)
+	filter.Set("aaa")
+	filter.Set("bbb")
+
+	if !filter.Check("aaa") || !filter.Check("bbb") {
+		t.Fatal("added values must be found")
+	}
+	t.Log(filter.Check("ccc"))
+}
+
+func TestBlockedBloomFalsePositives(t *testing.T) {
+	const n = 100000
+	filter := NewBlockedBloomFilter(n*10, 6)
+	for i := 0; i < n; i++ {
+		filter.Set(fmt.Sprintf("key%d", i))
+	}
+	for i := 0; i < n; i++ {
+		if !filter.Check(fmt.Sprintf("key%d", i)) {
+			t.Fatalf("false negative: key%d", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < n; i++ {
+		if filter.Check(fmt.Sprintf("other%d", i)) {
+			falsePositives++
+		}
+	}
+	// An ideal filter with 10 bits per value and 6 hashes has about 0.84%.
+	rate := float64(falsePositives) / n
+	t.Logf("false positive rate: %.4f", rate)
+	if rate > 0.02 {
+		t.Fatalf("false positive rate %.4f is far above the expected 0.01", rate)
+	}
+}
+
+// A 32MB filter and a million random keys keep the working set well outside
+// the CPU caches. Sequential keys would let BloomFilter's multiplicative hash
+// cluster its bits and hide the cost of the random accesses.
+const benchFilterBits = 1 << 28
+
+func benchKeys() []string {
+	keys := make([]string, 1<<20)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%016x", rand.Uint64())
+	}
+	return keys
+}
+
+func BenchmarkBloomFilterSet(b *testing.B) {
+	filter := NewBloomFilter(benchFilterBits)
+	keys := benchKeys()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		filter.Set(keys[i&(len(keys)-1)])
+	}
+}
+
+func BenchmarkBlockedBloomFilterSet(b *testing.B) {
+	filter := NewBlockedBloomFilter(benchFilterBits, 3)
+	keys := benchKeys()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		filter.Set(keys[i&(len(keys)-1)])
+	}
+}
+
+func BenchmarkBloomFilterCheck(b *testing.B) {
+	filter := NewBloomFilter(benchFilterBits)
+	keys := benchKeys()
+	for i := 0; i < len(keys); i += 2 {
+		filter.Set(keys[i])
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		filter.Check(keys[i&(len(keys)-1)])
+	}
+}
+
+func BenchmarkBlockedBloomFilterCheck(b *testing.B) {
+	filter := NewBlockedBloomFilter(benchFilterBits, 3)
+	keys := benchKeys()
+	for i := 0; i < len(keys); i += 2 {
+		filter.Set(keys[i])
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		filter.Check(keys[i&(len(keys)-1)])
+	}
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestRotatingBloomInterval(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	filter := NewRotatingBloomFilter(3, 1024, WithRotateInterval(time.Minute), WithClock(clock.Now))
+
+	filter.Set("aaa")
+	clock.Advance(time.Minute)
+	filter.Set("bbb")
+	clock.Advance(time.Minute)
+	if !filter.Check("aaa") || !filter.Check("bbb") {
+		t.Fatal("values within the last generations must be found")
+	}
+
+	// aaa was written two rotations ago and is now in the dropped generation.
+	clock.Advance(time.Minute)
+	if filter.Check("aaa") {
+		t.Fatal("aaa must have expired")
+	}
+	if !filter.Check("bbb") {
+		t.Fatal("bbb must still be found")
+	}
+
+	// A long idle period clears every generation at once.
+	clock.Advance(time.Hour)
+	if filter.Check("bbb") {
+		t.Fatal("bbb must have expired")
+	}
+}
+
+func TestRotatingBloomItems(t *testing.T) {
+	filter := NewRotatingBloomFilter(2, 1024, WithRotateItems(2))
+
+	if filter.CheckAndSet("aaa") {
+		t.Fatal("aaa has not been seen yet")
+	}
+	if !filter.CheckAndSet("aaa") {
+		t.Fatal("aaa must have been seen")
+	}
+	// The newest generation is full, so these writes rotate twice.
+	filter.Set("bbb")
+	filter.Set("ccc")
+	filter.Set("ddd")
+	if filter.Check("aaa") {
+		t.Fatal("aaa must have expired")
+	}
+	if !filter.Check("bbb") || !filter.Check("ddd") {
+		t.Fatal("recent values must be found")
+	}
+}
@@ -0,0 +1,25 @@
+package bloom
+
+// Hash64 is 64-bit FNV-1a followed by the murmur3 finalizer, so that every
+// output bit depends on every input byte, even for short similar keys. It is
+// exported for the other sketches built beside the Bloom filters.
+func Hash64(value string) uint64 {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(value); i++ {
+		hash ^= uint64(value[i])
+		hash *= 1099511628211
+	}
+	return Mix64(hash)
+}
+
+// Mix64 is the murmur3 finalizer, which spreads every bit of hash over all
+// output bits. It is exported for sketches that rehash a Hash64 value, for
+// instance with a seed.
+func Mix64(hash uint64) uint64 {
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
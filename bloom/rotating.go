@@ -0,0 +1,134 @@
+package bloom
+
+import "time"
+
+// RotatingBloomFilter forgets old values by keeping several generations of
+// BloomFilter. Values are written into the newest generation and looked up
+// in all of them; on rotation the oldest generation is dropped and an empty
+// one becomes the newest.
+//
+// A value therefore stays visible for between generations-1 and generations
+// rotation periods after it was last set. Rotation happens lazily during Set
+// and Check, when the configured interval has passed or the newest
+// generation has received the configured number of values.
+type RotatingBloomFilter struct {
+	// Generations ordered from oldest to newest.
+	generations []*BloomFilter
+	size        uint
+
+	interval  time.Duration
+	maxItems  uint
+	items     uint
+	rotatedAt time.Time
+	now       func() time.Time
+}
+
+// RotatingOption configures a RotatingBloomFilter.
+type RotatingOption func(filter *RotatingBloomFilter)
+
+// WithRotateInterval rotates the generations every interval.
+func WithRotateInterval(interval time.Duration) RotatingOption {
+	return func(filter *RotatingBloomFilter) {
+		filter.interval = interval
+	}
+}
+
+// WithRotateItems rotates the generations whenever the newest one has
+// received items values.
+func WithRotateItems(items uint) RotatingOption {
+	return func(filter *RotatingBloomFilter) {
+		filter.maxItems = items
+	}
+}
+
+// WithClock replaces time.Now as the source of the current time.
+func WithClock(now func() time.Time) RotatingOption {
+	return func(filter *RotatingBloomFilter) {
+		filter.now = now
+	}
+}
+
+// NewRotatingBloomFilter returns a filter of generations BloomFilters of the
+// given size each. Without WithRotateInterval or WithRotateItems it only
+// rotates when Rotate is called.
+func NewRotatingBloomFilter(generations int, size uint, opts ...RotatingOption) *RotatingBloomFilter {
+	if generations < 1 {
+		generations = 1
+	}
+
+	filter := &RotatingBloomFilter{
+		size: size,
+		now:  time.Now,
+	}
+	for _, opt := range opts {
+		opt(filter)
+	}
+
+	filter.generations = make([]*BloomFilter, generations)
+	for i := range filter.generations {
+		filter.generations[i] = NewBloomFilter(size)
+	}
+	filter.rotatedAt = filter.now()
+	return filter
+}
+
+func (filter *RotatingBloomFilter) Set(value string) {
+	filter.maybeRotate()
+	filter.generations[len(filter.generations)-1].Set(value)
+	filter.items++
+}
+
+func (filter *RotatingBloomFilter) Check(value string) bool {
+	filter.maybeRotate()
+	for i := len(filter.generations) - 1; i >= 0; i-- {
+		if filter.generations[i].Check(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckAndSet sets value and reports whether it may have been seen before,
+// which is the single call a stream deduplicator needs.
+func (filter *RotatingBloomFilter) CheckAndSet(value string) bool {
+	seen := filter.Check(value)
+	filter.Set(value)
+	return seen
+}
+
+// Rotate drops the oldest generation and starts a new, empty one.
+func (filter *RotatingBloomFilter) Rotate() {
+	filter.rotate(1)
+	filter.rotatedAt = filter.now()
+}
+
+func (filter *RotatingBloomFilter) maybeRotate() {
+	if filter.maxItems > 0 && filter.items >= filter.maxItems {
+		filter.Rotate()
+		return
+	}
+
+	if filter.interval <= 0 {
+		return
+	}
+	elapsed := filter.now().Sub(filter.rotatedAt)
+	if elapsed < filter.interval {
+		return
+	}
+	// Every missed period ages the data by one generation, so a filter that
+	// sat idle for long enough comes back empty.
+	periods := int(elapsed / filter.interval)
+	filter.rotate(periods)
+	filter.rotatedAt = filter.rotatedAt.Add(time.Duration(periods) * filter.interval)
+}
+
+func (filter *RotatingBloomFilter) rotate(n int) {
+	if n > len(filter.generations) {
+		n = len(filter.generations)
+	}
+	copy(filter.generations, filter.generations[n:])
+	for i := len(filter.generations) - n; i < len(filter.generations); i++ {
+		filter.generations[i] = NewBloomFilter(filter.size)
+	}
+	filter.items = 0
+}
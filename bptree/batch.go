@@ -0,0 +1,68 @@
+package bptree
+
+// Batch collects Set and Remove operations to apply to a tree at once. The
+// zero value is an empty batch ready to use.
+type Batch[K any, V any] struct {
+	ops []batchOp[K, V]
+}
+
+type batchOp[K any, V any] struct {
+	key    K
+	value  V
+	remove bool
+}
+
+// Set adds setting key to value to the batch.
+func (b *Batch[K, V]) Set(key K, value V) {
+	b.ops = append(b.ops, batchOp[K, V]{key: key, value: value})
+}
+
+// Remove adds removing key to the batch.
+func (b *Batch[K, V]) Remove(key K) {
+	b.ops = append(b.ops, batchOp[K, V]{key: key, remove: true})
+}
+
+// Len returns the number of operations in the batch.
+func (b *Batch[K, V]) Len() int {
+	return len(b.ops)
+}
+
+// Reset empties the batch so that it can be reused.
+func (b *Batch[K, V]) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Apply performs the operations of b in order, atomically: readers and
+// snapshots see either none or all of them, and a tree opened from a file
+// logs them as a single record, so a crash also keeps all or none.
+//
+// For a tree opened from a file Apply returns Err, like Flush does. If a
+// leaf of a spill tree or of a tree opened from a file does not load, Apply
+// returns the error and applies none of b.
+func (t *Tree[K, V]) Apply(b *Batch[K, V]) error {
+	t.lock()
+	defer t.unlock()
+
+	if err := t.prepareBatch(b.ops); err != nil {
+		return err
+	}
+	t.apply(b.ops)
+	return t.storeErr()
+}
+
+func (t *Tree[K, V]) apply(ops []batchOp[K, V]) {
+	if len(ops) == 0 {
+		return
+	}
+
+	t.logBatch(ops)
+	for _, op := range ops {
+		if op.remove {
+			t.remove(op.key, nil)
+		} else {
+			t.set(op.key, op.value)
+		}
+	}
+	t.trackBatch(ops)
+	t.maybeCheckpoint()
+}
@@ -0,0 +1,116 @@
+package bptree
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	tree := NewOrderedTree[int64, string](4)
+	tree.Set(1, "one")
+	tree.Set(2, "two")
+
+	var b Batch[int64, string]
+	b.Set(3, "three")
+	b.Remove(1)
+	b.Set(2, "deux")
+	b.Set(3, "trois")
+	if b.Len() != 4 {
+		t.Fatalf("Len() = %d, want 4", b.Len())
+	}
+	if err := tree.Apply(&b); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := treeContents(tree), map[int64]string{2: "deux", 3: "trois"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("tree = %v, want %v", got, want)
+	}
+	if tree.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", tree.Len())
+	}
+
+	b.Reset()
+	if err := tree.Apply(&b); err != nil || b.Len() != 0 || tree.Len() != 2 {
+		t.Fatal("an empty batch must change nothing")
+	}
+}
+
+func TestBatchAtomic(t *testing.T) {
+	tree := NewOrderedTree[int64, int](8)
+	for i := int64(0); i < 100; i++ {
+		tree.Set(i, 0)
+	}
+
+	// Every batch sets all keys to the same value, so a reader that sees a
+	// batch half applied finds two different values.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 1; round <= 200; round++ {
+			var b Batch[int64, int]
+			for i := int64(0); i < 100; i++ {
+				b.Set(i, round)
+			}
+			tree.Apply(&b)
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		var first int
+		seen := 0
+		tree.Range(0, 99, func(key int64, val int) bool {
+			if seen == 0 {
+				first = val
+			} else if val != first {
+				t.Errorf("key %d = %d, key 0 = %d", key, val, first)
+				return false
+			}
+			seen++
+			return true
+		})
+	}
+	wg.Wait()
+}
+
+func TestBatchDisk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.db")
+	tree, err := Open(path, stringOptions(4, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b Batch[int64, string]
+	for i := int64(0); i < 50; i++ {
+		b.Set(i, "a")
+	}
+	b.Remove(10)
+	if err := tree.Apply(&b); err != nil {
+		t.Fatal(err)
+	}
+	size := tree.store.wal.size
+
+	reopened, err := Open(path, stringOptions(4, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := treeContents(reopened); len(data) != 49 || data[49] != "a" {
+		t.Fatalf("replayed %d keys, want 49", len(data))
+	}
+	reopened.store.pager.file.Close()
+	reopened.store.wal.file.Close()
+
+	// A batch torn by a crash is dropped as a whole.
+	if err := os.Truncate(path+".wal", size-1); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err = Open(path, stringOptions(4, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if reopened.Len() != 0 {
+		t.Fatalf("Len() = %d after a torn batch, want 0", reopened.Len())
+	}
+}
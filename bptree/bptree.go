@@ -1,77 +1,197 @@
 package bptree
 
-import "sync"
+import (
+	"bytes"
+	"sync"
+)
+
+// Tree is a B+ tree mapping keys of type K to values of type V, ordered by a
+// comparator. It is safe for concurrent use. Readers run in parallel, and so
+// do Set, Remove, Update, CompareAndSwap and GetOrSet on keys in different
+// leaves as long as they neither split nor merge nodes nor change the last
+// key of a leaf, in trees kept in memory that have no open snapshots or
+// transactions. All other writes, including those that split or merge and
+// every Add, RemoveValue, Apply, Commit and RemoveRange, lock the whole tree
+// and run one at a time.
+//
+// Callbacks such as those of Range run with the tree's read lock held, and
+// an Iterator holds it until Close. A sync.RWMutex blocks new readers once a
+// writer waits for it, so a callback, or the goroutine of an open Iterator,
+// must not call into the tree at all, not even to read it.
+//
+// Keys are only ever compared with the comparator, so they need not be
+// comparable with ==: NewBytesTree orders byte-slice keys. Keys must not be
+// modified after they are added, which for byte slices means the caller
+// must not reuse the arrays behind them.
+type Tree[K any, V any] struct {
+	// Keys added by writers that held only the read lock, which lock folds
+	// into count, see updateLatched. It comes first to be 64-bit aligned for
+	// atomic access on 32-bit platforms.
+	added int64
 
-type BPTree struct {
 	mu    sync.RWMutex
-	ktype int
-	root  *bpNode
+	cmp   func(a, b K) int
+	root  *bpNode[K, V]
 	width int
 	halfw int
+	count int
+	multi bool
+
+	// Nodes with a version older than epoch may be shared with one of the
+	// open snapshots and are copied before they are changed.
+	epoch     uint64
+	snapshots int
+
+	// The number of commits made while transactions were open, the start of
+	// every open transaction, and the keys committed since the oldest of them
+	// began.
+	seq     uint64
+	txns    map[uint64]int
+	commits []txnCommit[K]
+
+	// The file the tree was opened from, nil for in-memory trees.
+	store *diskStore[K, V]
+
+	// The page cache of a tree created by NewSpillTree, nil otherwise.
+	cache *leafCache[K, V]
+
+	// Packs the keys of frozen leaves, set by Freeze.
+	packer *keyPacker[K]
 }
 
-func NewBPTree(width int) *BPTree {
+// BPTree is the int64-keyed tree this package started out with. It has
+// every method of Tree, and GetData as a method too.
+type BPTree struct {
+	*Tree[int64, interface{}]
+}
+
+// Ordered is the set of types whose values can be compared with < and >.
+type Ordered interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64 | ~string
+}
+
+// Compare returns -1, 0 or +1 depending on whether a is less than, equal to
+// or greater than b. It is the comparator of the trees created by
+// NewOrderedTree.
+func Compare[K Ordered](a, b K) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// NewTree returns an empty tree with at most width keys or children per node,
+// ordering keys with compare, which must return a negative number, zero or a
+// positive number when a is less than, equal to or greater than b.
+func NewTree[K any, V any](width int, compare func(a, b K) int) *Tree[K, V] {
 	if width < 3 {
 		width = 3
 	}
 
-	tree := &BPTree{}
-	tree.root = newLeafNode(width)
+	tree := &Tree[K, V]{}
+	tree.root = newLeafNode[K, V](width)
+	tree.cmp = compare
 	tree.width = width
 	tree.halfw = (tree.width + 1) / 2
 	return tree
 }
 
-func (t *BPTree) Get(key int64) interface{} {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
+// NewOrderedTree returns an empty tree whose keys are ordered by their
+// natural order.
+func NewOrderedTree[K Ordered, V any](width int) *Tree[K, V] {
+	return NewTree[K, V](width, Compare[K])
+}
+
+// NewBytesTree returns an empty tree with byte-slice keys, ordered by
+// bytes.Compare.
+func NewBytesTree[V any](width int) *Tree[[]byte, V] {
+	return NewTree[[]byte, V](width, bytes.Compare)
+}
 
+// NewBPTree returns an empty int64-keyed tree.
+func NewBPTree(width int) *BPTree {
+	return &BPTree{NewOrderedTree[int64, interface{}](width)}
+}
+
+// GetData returns the nodes of the tree as nested maps, see the GetData
+// function.
+func (t *BPTree) GetData() map[int64]interface{} {
+	return GetData(t.Tree)
+}
+
+func (t *Tree[K, V]) Get(key K) V {
+	value, _ := t.lookup(key)
+	return value
+}
+
+// lookup is Get that also reports whether key exists.
+func (t *Tree[K, V]) lookup(key K) (V, bool) {
+	t.rlock()
+	defer t.runlock()
+
+	var zero V
 	node := t.root
-	for i := 0; i < len(node.nodes); i++ {
-		if key <= node.nodes[i].maxKey {
-			node = node.nodes[i]
-			i = 0
-		}
+	for len(node.nodes) > 0 {
+		node = node.nodes[node.findChild(t.cmp, key)]
 	}
-
-	if len(node.nodes) > 0 {
-		return nil
+	t.load(node)
+	t.rlatch(node)
+	defer t.runlatch(node)
+	if i := t.find(node, key); i >= 0 {
+		return node.values[i], true
 	}
+	return zero, false
+}
 
-	for i := 0; i < len(node.items); i++ {
-		if node.items[i].key == key {
-			return node.items[i].value
-		}
+func (t *Tree[K, V]) Set(key K, value V) {
+	if t.updateLatched(key, false, func(leaf *bpNode[K, V], i int, found bool) int {
+		return t.updateItem(leaf, i, found, key, value)
+	}) {
+		return
 	}
-	return nil
-}
 
-func (t *BPTree) Set(key int64, value interface{}) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+	t.lock()
+	defer t.unlock()
 
-	t.setValue(nil, t.root, key, value)
+	if t.prepare(key, false) != nil {
+		return
+	}
+	t.logSet(key, value)
+	t.set(key, value)
+	t.track(key)
+	t.maybeCheckpoint()
 }
 
-func (t *BPTree) GetData() map[int64]interface{} {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
+// GetData returns the nodes of the tree as nested maps, keyed by the maxKey
+// of each child in index nodes and by the keys in leaves. It is a function
+// rather than a method since the keys must be comparable to key a map.
+func GetData[K comparable, V any](t *Tree[K, V]) map[K]interface{} {
+	t.rlock()
+	defer t.runlock()
 
-	return t.getData(t.root)
+	return getData(t, t.root)
 }
 
-func (t *BPTree) getData(node *bpNode) map[int64]interface{} {
-	data := make(map[int64]interface{})
+func getData[K comparable, V any](t *Tree[K, V], node *bpNode[K, V]) map[K]interface{} {
+	data := make(map[K]interface{})
 
 	for {
 		if len(node.nodes) > 0 {
 			for i := 0; i < len(node.nodes); i++ {
-				data[node.nodes[i].maxKey] = t.getData(node.nodes[i])
+				data[node.keys[i]] = getData(t, node.nodes[i])
 			}
 			break
 		} else {
-			for i := 0; i < len(node.items); i++ {
-				data[node.items[i].key] = node.items[i].value
+			t.pin(node)
+			defer t.unpin(node)
+			t.rlatch(node)
+			defer t.runlatch(node)
+			for i, key := range t.leafKeys(node) {
+				data[key] = node.values[i]
 			}
 			break
 		}
@@ -79,177 +199,309 @@ func (t *BPTree) getData(node *bpNode) map[int64]interface{} {
 	return data
 }
 
-func (t *BPTree) splitNode(node *bpNode) *bpNode {
+func (t *Tree[K, V]) splitNode(node *bpNode[K, V]) *bpNode[K, V] {
 	if len(node.nodes) > t.width {
 		halfw := t.width/2 + 1
-		node2 := newIndexNode(t.width)
+		node2 := newIndexNode[K, V](t.width)
+		node2.version = t.epoch
 		node2.nodes = append(node2.nodes, node.nodes[halfw:len(node.nodes)]...)
-		node2.maxKey = node2.nodes[len(node2.nodes)-1].maxKey
+		node2.keys = append(node2.keys, node.keys[halfw:len(node.keys)]...)
+		node2.maxKey = node2.keys[len(node2.keys)-1]
 
 		node.nodes = node.nodes[0:halfw]
-		node.maxKey = node.nodes[len(node.nodes)-1].maxKey
+		node.keys = node.keys[0:halfw]
+		node.dirty = true
+		node.maxKey = node.keys[len(node.keys)-1]
+		node2.recount()
+		node.size -= node2.size
 		return node2
-	} else if len(node.items) > t.width {
+	} else if len(node.keys) > t.width {
 		halfw := t.width/2 + 1
-		node2 := newLeafNode(t.width)
-		node2.items = append(node2.items, node.items[halfw:len(node.items)]...)
-		node2.maxKey = node2.items[len(node2.items)-1].key
-
+		node2 := newLeafNode[K, V](t.width)
+		node2.version = t.epoch
+		t.admit(node2)
+		node2.keys = append(node2.keys, node.keys[halfw:len(node.keys)]...)
+		node2.values = append(node2.values, node.values[halfw:len(node.values)]...)
+		node2.maxKey = node2.keys[len(node2.keys)-1]
+
+		node2.next = node.next
+		node2.prev = node
+		if node.next != nil {
+			node.next.prev = node2
+		}
 		node.next = node2
-		node.items = node.items[0:halfw]
-		node.maxKey = node.items[len(node.items)-1].key
+		node.removeItems(halfw, len(node.keys))
 		return node2
 	}
 	return nil
 }
 
-func (t *BPTree) setValue(parent *bpNode, node *bpNode, key int64, value interface{}) {
-	for i := 0; i < len(node.nodes); i++ {
-		if key <= node.nodes[i].maxKey || i == len(node.nodes)-1 {
-			t.setValue(node, node.nodes[i], key, value)
-			break
+// setValue reports whether key was newly added rather than replaced. With
+// dup set it always adds key, after any values it already has.
+func (t *Tree[K, V]) setValue(parent *bpNode[K, V], node *bpNode[K, V], key K, value V, dup bool) bool {
+	added := false
+	if len(node.nodes) > 0 {
+		i := node.findChild(t.cmp, key)
+		if dup {
+			i = node.findLastChild(t.cmp, key)
 		}
+		added = t.setValue(node, t.mutableChild(node, i), key, value, dup)
+		if added {
+			node.size++
+		}
+		node.fixKey(i)
+	} else if dup {
+		node.addValue(t.cmp, key, value)
+		added = true
+	} else {
+		added = node.setValue(t.cmp, key, value)
 	}
 
-	if len(node.nodes) < 1 {
-		node.setValue(key, value)
-	}
+	t.split(parent, node)
+	return added
+}
 
+// split splits node if it has grown past width, adding the new node to
+// parent or to a new root above node.
+func (t *Tree[K, V]) split(parent *bpNode[K, V], node *bpNode[K, V]) {
 	newNode := t.splitNode(node)
 	if newNode != nil {
 		if parent == nil {
-			parent = newIndexNode(t.width)
-			parent.addChild(node)
+			parent = newIndexNode[K, V](t.width)
+			parent.version = t.epoch
+			parent.addChild(nil, node)
+			parent.size = int64(node.count() + newNode.count())
 			t.root = parent
 		}
-		parent.addChild(newNode)
+		parent.addChild(node, newNode)
 	}
 }
 
-func (t *BPTree) itemMoveOrMerge(parent *bpNode, node *bpNode) {
-	var node1 *bpNode = nil
-	var node2 *bpNode = nil
+func (t *Tree[K, V]) itemMoveOrMerge(parent *bpNode[K, V], node *bpNode[K, V]) {
+	if parent == nil {
+		return
+	}
+
+	var node1 *bpNode[K, V] = nil
+	var node2 *bpNode[K, V] = nil
 	for i := 0; i < len(parent.nodes); i++ {
 		if parent.nodes[i] == node {
 			if i < len(parent.nodes)-1 {
-				node2 = parent.nodes[i+1]
+				node2 = t.mutableChild(parent, i+1)
 			} else if i > 0 {
-				node1 = parent.nodes[i-1]
+				node1 = t.mutableChild(parent, i-1)
 			}
 			break
 		}
 	}
+	// The siblings' maxKeys change below, and so do the parent's keys.
+	defer parent.rekey()
 
 	//将左侧结点的记录移动到删除结点
-	if node1 != nil && len(node1.items) > t.halfw {
-		item := node1.items[len(node1.items)-1]
-		node1.items = node1.items[0 : len(node1.items)-1]
-		node1.maxKey = node1.items[len(node1.items)-1].key
-		node.items = append([]bpItem{item}, node.items...)
+	if node1 != nil && len(node1.keys) > t.halfw {
+		last := len(node1.keys) - 1
+		key, value := node1.keys[last], node1.values[last]
+		node1.removeItem(last)
+		node.insertItem(0, key, value)
 		return
 	}
 
 	//将右侧结点的记录移动到删除结点
-	if node2 != nil && len(node2.items) > t.halfw {
-		item := node2.items[0]
-		node2.items = node1.items[1:]
-		node.items = append(node.items, item)
-		node.maxKey = node.items[len(node.items)-1].key
+	if node2 != nil && len(node2.keys) > t.halfw {
+		key, value := node2.keys[0], node2.values[0]
+		node2.removeItem(0)
+		node.insertItem(len(node.keys), key, value)
 		return
 	}
 
 	//与左侧结点进行合并
-	if node1 != nil && len(node1.items)+len(node.items) <= t.width {
-		node1.items = append(node1.items, node.items...)
+	if node1 != nil && len(node1.keys)+len(node.keys) <= t.width {
+		node1.keys = append(node1.keys, node.keys...)
+		node1.values = append(node1.values, node.values...)
 		node1.next = node.next
-		node1.maxKey = node1.items[len(node1.items)-1].key
+		if node.next != nil {
+			node.next.prev = node1
+		}
+		node1.maxKey = node1.keys[len(node1.keys)-1]
+		node1.dirty = true
 		parent.deleteChild(node)
+		t.release(node)
 		return
 	}
 
 	//与右侧结点进行合并
-	if node2 != nil && len(node2.items)+len(node.items) <= t.width {
-		node.items = append(node.items, node2.items...)
+	if node2 != nil && len(node2.keys)+len(node.keys) <= t.width {
+		node.keys = append(node.keys, node2.keys...)
+		node.values = append(node.values, node2.values...)
 		node.next = node2.next
-		node.maxKey = node.items[len(node.items)-1].key
+		if node2.next != nil {
+			node2.next.prev = node
+		}
+		node.maxKey = node.keys[len(node.keys)-1]
+		node.dirty = true
 		parent.deleteChild(node2)
+		t.release(node2)
 		return
 	}
 }
 
-func (t *BPTree) childMoveOrMerge(parent *bpNode, node *bpNode) {
+func (t *Tree[K, V]) childMoveOrMerge(parent *bpNode[K, V], node *bpNode[K, V]) {
 	if parent == nil {
 		return
 	}
 
 	//获取兄弟结点
-	var node1 *bpNode = nil
-	var node2 *bpNode = nil
+	var node1 *bpNode[K, V] = nil
+	var node2 *bpNode[K, V] = nil
 	for i := 0; i < len(parent.nodes); i++ {
 		if parent.nodes[i] == node {
 			if i < len(parent.nodes)-1 {
-				node2 = parent.nodes[i+1]
+				node2 = t.mutableChild(parent, i+1)
 			} else if i > 0 {
-				node1 = parent.nodes[i-1]
+				node1 = t.mutableChild(parent, i-1)
 			}
 			break
 		}
 	}
+	defer parent.rekey()
 
 	//将左侧结点的子结点移动到删除结点
 	if node1 != nil && len(node1.nodes) > t.halfw {
 		item := node1.nodes[len(node1.nodes)-1]
 		node1.nodes = node1.nodes[0 : len(node1.nodes)-1]
-		node.nodes = append([]*bpNode{item}, node.nodes...)
+		node.nodes = append(node.nodes, nil)
+		copy(node.nodes[1:], node.nodes)
+		node.nodes[0] = item
+		node1.rekey()
+		node.rekey()
+		node1.size -= int64(item.count())
+		node.size += int64(item.count())
+		node1.dirty, node.dirty = true, true
 		return
 	}
 
 	//将右侧结点的子结点移动到删除结点
 	if node2 != nil && len(node2.nodes) > t.halfw {
 		item := node2.nodes[0]
-		node2.nodes = node1.nodes[1:]
+		node2.nodes = append(node2.nodes[:0], node2.nodes[1:]...)
 		node.nodes = append(node.nodes, item)
+		node2.rekey()
+		node.rekey()
+		node2.size -= int64(item.count())
+		node.size += int64(item.count())
+		node2.dirty, node.dirty = true, true
 		return
 	}
 
 	if node1 != nil && len(node1.nodes)+len(node.nodes) <= t.width {
 		node1.nodes = append(node1.nodes, node.nodes...)
+		node1.rekey()
+		node1.size += node.size
+		node1.dirty = true
 		parent.deleteChild(node)
+		t.release(node)
 		return
 	}
 
 	if node2 != nil && len(node2.nodes)+len(node.nodes) <= t.width {
 		node.nodes = append(node.nodes, node2.nodes...)
+		node.rekey()
+		node.size += node2.size
+		node.dirty = true
 		parent.deleteChild(node2)
+		t.release(node2)
 		return
 	}
 }
 
-func (t *BPTree) deleteItem(parent *bpNode, node *bpNode, key int64) {
-	for i := 0; i < len(node.nodes); i++ {
-		if key <= node.nodes[i].maxKey {
-			t.deleteItem(node, node.nodes[i], key)
+// deleteItem reports whether key was found and removed. It removes the
+// first value of key that satisfies match, or the first one if match is nil.
+func (t *Tree[K, V]) deleteItem(parent *bpNode[K, V], node *bpNode[K, V], key K, match func(V) bool) bool {
+	removed := false
+	// Duplicates of key may continue into the following children.
+	first := node.search(t.cmp, key)
+	for i := first; i < len(node.nodes); i++ {
+		if i > first && t.cmp(node.keys[i-1], key) != 0 {
+			break
+		}
+		if removed = t.deleteItem(node, t.mutableChild(node, i), key, match); removed {
+			node.size--
+			node.fixKey(i)
 			break
 		}
 	}
 
 	if len(node.nodes) < 1 {
 		//删除记录后若结点的子项<m/2，则从兄弟结点移动记录，或者合并结点
-		node.deleteItem(key)
-		if len(node.items) < t.halfw {
+		removed = node.deleteItem(t.cmp, key, match)
+		if len(node.keys) < t.halfw {
 			t.itemMoveOrMerge(parent, node)
 		}
-	} else {
+	} else if len(node.nodes) < t.halfw {
 		//若结点的子项<m/2，则从兄弟结点移动记录，或者合并结点
-		node.maxKey = node.nodes[len(node.nodes)-1].maxKey
-		if len(node.nodes) < t.halfw {
-			t.childMoveOrMerge(parent, node)
+		t.childMoveOrMerge(parent, node)
+	}
+	return removed
+}
+
+// Remove removes key and returns the value it had, reporting whether it was
+// there. In a multimap tree it removes the first value of key.
+func (t *Tree[K, V]) Remove(key K) (V, bool) {
+	var old V
+	removed := false
+	if t.updateLatched(key, true, func(leaf *bpNode[K, V], i int, found bool) int {
+		if !found {
+			return 0
 		}
+		old, removed = leaf.values[i], true
+		t.track(key)
+		leaf.removeItem(i)
+		return -1
+	}) {
+		return old, removed
+	}
+
+	t.lock()
+	defer t.unlock()
+
+	if t.prepare(key, true) != nil {
+		return old, false
+	}
+	removed = t.remove(key, func(v V) bool {
+		old = v
+		return true
+	})
+	if removed {
+		t.logRemove(key)
+		t.track(key)
+		t.maybeCheckpoint()
+	}
+	return old, removed
+}
+
+// set and remove change the tree without locking or logging.
+func (t *Tree[K, V]) set(key K, value V) {
+	t.root = t.mutable(t.root)
+	if t.setValue(nil, t.root, key, value, false) {
+		t.count++
 	}
 }
 
-func (t *BPTree) Remove(key int64) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	t.deleteItem(nil, t.root, key)
+func (t *Tree[K, V]) remove(key K, match func(V) bool) bool {
+	t.root = t.mutable(t.root)
+	removed := t.deleteItem(nil, t.root, key, match)
+	if removed {
+		t.count--
+	}
+	t.shrinkRoot()
+	return removed
+}
+
+// shrinkRoot replaces an index root left with a single child by the child.
+func (t *Tree[K, V]) shrinkRoot() {
+	for len(t.root.nodes) == 1 {
+		old := t.root
+		t.root = old.nodes[0]
+		t.release(old)
+	}
 }
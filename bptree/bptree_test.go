@@ -1,9 +1,13 @@
 package bptree
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"github.com/Pangjiping/goutils/utils"
 	"math/rand"
+	"reflect"
+	"runtime"
 	"testing"
 )
 
@@ -44,3 +48,166 @@ func TestBPTRand(t *testing.T) {
 	data, _ := json.MarshalIndent(bpt.GetData(), "", "    ")
 	t.Log(string(data))
 }
+
+func TestStringTree(t *testing.T) {
+	tree := NewOrderedTree[string, int](4)
+	keys := []string{"user:42:orders", "user:7:name", "user:42:name", "tenant:1", "user:100:name"}
+	for i, key := range keys {
+		tree.Set(key, i)
+	}
+	tree.Set("tenant:1", 99)
+
+	got := make([]string, 0)
+	tree.Range("user:", "user:\xff", func(key string, val int) bool {
+		got = append(got, key)
+		return true
+	})
+	want := []string{"user:100:name", "user:42:name", "user:42:orders", "user:7:name"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Range = %v, want %v", got, want)
+	}
+
+	it := tree.Iterator()
+	defer it.Close()
+	if !it.First() || it.Key() != "tenant:1" || it.Value() != 99 {
+		t.Fatalf("first entry is %s=%d, want tenant:1=99", it.Key(), it.Value())
+	}
+}
+
+func TestBytesTree(t *testing.T) {
+	tree := NewBytesTree[int](3)
+	keys := [][]byte{{0x01, 0xff}, {0x00}, {0x01}, {0xff, 0x00}, {}, nil}
+	for i, key := range keys[:5] {
+		tree.Set(key, i)
+	}
+	// nil and the empty slice are the same key to bytes.Compare.
+	tree.Set(nil, 5)
+	if tree.Len() != 5 || tree.Get([]byte{}) != 5 || tree.Get([]byte{0x01}) != 2 {
+		t.Fatalf("Len() = %d, Get([]) = %d, Get([1]) = %d", tree.Len(), tree.Get([]byte{}), tree.Get([]byte{0x01}))
+	}
+
+	var got [][]byte
+	tree.Ascend(nil, func(key []byte, val int) bool {
+		got = append(got, key)
+		return true
+	})
+	want := [][]byte{{}, {0x00}, {0x01}, {0x01, 0xff}, {0xff, 0x00}}
+	if len(got) != len(want) {
+		t.Fatalf("Ascend visited %d keys, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("Ascend visited %v, want %v", got, want)
+		}
+	}
+
+	// Transactions track byte-slice keys by the comparator too.
+	tx := tree.Begin()
+	if val, ok := tx.Get([]byte{0x00}); !ok || val != 1 {
+		t.Fatalf("tx.Get([0]) = %d, %v", val, ok)
+	}
+	tx.Set([]byte{0x02}, 7)
+	if val, ok := tx.Get([]byte{0x02}); !ok || val != 7 {
+		t.Fatalf("tx.Get([2]) = %d, %v after tx.Set", val, ok)
+	}
+	tree.Set([]byte{0x00}, 8)
+	if err := tx.Commit(); err != ErrConflict {
+		t.Fatalf("Commit() = %v, want %v", err, ErrConflict)
+	}
+	if err := tree.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type compositeKey struct {
+	tenant int
+	name   string
+}
+
+func TestTreeComparator(t *testing.T) {
+	// Tenants in descending order, names ascending within a tenant.
+	tree := NewTree[compositeKey, string](4, func(a, b compositeKey) int {
+		if a.tenant != b.tenant {
+			return Compare(b.tenant, a.tenant)
+		}
+		return Compare(a.name, b.name)
+	})
+	for tenant := 1; tenant <= 5; tenant++ {
+		for _, name := range []string{"c", "a", "b"} {
+			tree.Set(compositeKey{tenant, name}, fmt.Sprintf("%d%s", tenant, name))
+		}
+	}
+
+	got := ""
+	tree.Range(compositeKey{4, ""}, compositeKey{3, "b"}, func(key compositeKey, val string) bool {
+		got += val + " "
+		return true
+	})
+	if got != "4a 4b 4c 3a 3b " {
+		t.Fatalf("Range = %q", got)
+	}
+}
+
+var benchWidths = []int{4, 8, 16, 32, 64, 128, 256, 512}
+
+func BenchmarkGet(b *testing.B) {
+	keys := rand.New(rand.NewSource(1)).Perm(1 << 16)
+	for _, width := range benchWidths {
+		tree := NewOrderedTree[int, int](width)
+		for _, key := range keys {
+			tree.Set(key, key)
+		}
+		b.Run(fmt.Sprintf("width=%d", width), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				tree.Get(keys[i&(len(keys)-1)])
+			}
+		})
+	}
+}
+
+func BenchmarkSet(b *testing.B) {
+	keys := rand.New(rand.NewSource(1)).Perm(1 << 16)
+	for _, width := range benchWidths {
+		b.Run(fmt.Sprintf("width=%d", width), func(b *testing.B) {
+			tree := NewOrderedTree[int, int](width)
+			for i := 0; i < b.N; i++ {
+				tree.Set(keys[i&(len(keys)-1)], i)
+			}
+		})
+	}
+}
+
+// BenchmarkNodeMemory reports the heap taken by an empty index node and an
+// empty leaf, with their arrays. Index nodes carry no leaf state.
+func BenchmarkNodeMemory(b *testing.B) {
+	const n = 1 << 14
+	kinds := []struct {
+		name string
+		make func(width int) *bpNode[int, int]
+	}{
+		{"index", newIndexNode[int, int]},
+		{"leaf", newLeafNode[int, int]},
+	}
+	for _, width := range []int{16, 64} {
+		for _, kind := range kinds {
+			b.Run(fmt.Sprintf("width=%d/%s", width, kind.name), func(b *testing.B) {
+				nodes := make([]*bpNode[int, int], n)
+				var before, after runtime.MemStats
+				for i := 0; i < b.N; i++ {
+					for j := range nodes {
+						nodes[j] = nil
+					}
+					runtime.GC()
+					runtime.ReadMemStats(&before)
+					for j := range nodes {
+						nodes[j] = kind.make(width)
+					}
+					runtime.GC()
+					runtime.ReadMemStats(&after)
+				}
+				runtime.KeepAlive(nodes)
+				b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/n, "bytes/node")
+			})
+		}
+	}
+}
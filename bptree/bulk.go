@@ -0,0 +1,173 @@
+package bptree
+
+import "errors"
+
+var (
+	// ErrUnsorted is returned by BulkLoad when the keys are not strictly
+	// ascending.
+	ErrUnsorted = errors.New("bptree: keys are not in ascending order")
+
+	// ErrNotEmpty is returned by BulkLoad on a tree that already has keys.
+	ErrNotEmpty = errors.New("bptree: tree is not empty")
+)
+
+// BulkLoad fills an empty tree with the pairs returned by next until it
+// reports false. The keys must be strictly ascending, or ascending for a
+// multimap tree.
+//
+// Instead of inserting the pairs one by one, BulkLoad packs them into leaves
+// and builds the index levels bottom-up, filling each node to fill times the
+// tree width. fill is clamped between 0.5 and 1: full nodes make the
+// smallest tree, while some slack avoids splits when keys are added later.
+//
+// On error the tree is left empty. A tree opened from a file is checkpointed
+// once loaded. Open transactions that read or wrote any of the loaded keys
+// fail to commit, as after any other write.
+func (t *Tree[K, V]) BulkLoad(next func() (key K, value V, ok bool), fill float64) error {
+	t.lock()
+	defer t.unlock()
+
+	if err := t.storeErr(); err != nil {
+		return err
+	}
+	if t.count > 0 {
+		return ErrNotEmpty
+	}
+
+	per := int(fill*float64(t.width) + 0.5)
+	if per < t.halfw {
+		per = t.halfw
+	} else if per > t.width {
+		per = t.width
+	}
+
+	// Open transactions need to know which keys were added.
+	var keys []K
+	track := len(t.txns) > 0
+
+	var level []*bpNode[K, V]
+	var leaf *bpNode[K, V]
+	count := 0
+	for {
+		key, value, ok := next()
+		if !ok {
+			break
+		}
+		if leaf != nil {
+			if c := t.cmp(leaf.maxKey, key); c > 0 || c == 0 && !t.multi {
+				for _, node := range level {
+					node.pins = 0
+					t.release(node)
+				}
+				return ErrUnsorted
+			}
+		}
+		if leaf == nil || len(leaf.keys) == per {
+			node := newLeafNode[K, V](t.width)
+			node.version = t.epoch
+			if leaf != nil {
+				leaf.next = node
+				node.prev = leaf
+				// A spill tree keeps the last two leaves in memory for
+				// balanceLast and may spill the others as it goes.
+				t.unpin(leaf.prev)
+			}
+			t.pin(node)
+			leaf = node
+			level = append(level, leaf)
+		}
+		leaf.keys = append(leaf.keys, key)
+		leaf.values = append(leaf.values, value)
+		leaf.maxKey = key
+		count++
+		if track {
+			keys = append(keys, key)
+		}
+	}
+	if count == 0 {
+		return nil
+	}
+
+	level = t.balanceLast(level)
+	t.unpin(leaf.prev)
+	t.unpin(leaf)
+	for len(level) > 1 {
+		var parents []*bpNode[K, V]
+		for i := 0; i < len(level); i += per {
+			end := i + per
+			if end > len(level) {
+				end = len(level)
+			}
+			node := newIndexNode[K, V](t.width)
+			node.version = t.epoch
+			node.nodes = append(node.nodes, level[i:end]...)
+			node.rekey()
+			node.recount()
+			parents = append(parents, node)
+		}
+		level = t.balanceLast(parents)
+	}
+
+	t.release(t.root)
+	t.root = level[0]
+	t.count = count
+	t.trackKeys(keys)
+	if t.store != nil {
+		t.store.err = t.checkpoint()
+		return t.store.err
+	}
+	return nil
+}
+
+// balanceLast fixes the last node of a level built by BulkLoad when it has
+// fewer than half of width entries, by merging it into its left neighbour or
+// sharing their entries evenly.
+func (t *Tree[K, V]) balanceLast(level []*bpNode[K, V]) []*bpNode[K, V] {
+	n := len(level)
+	if n < 2 {
+		return level
+	}
+	left, last := level[n-2], level[n-1]
+
+	if len(last.nodes) > 0 {
+		if len(last.nodes) >= t.halfw {
+			return level
+		}
+		if len(left.nodes)+len(last.nodes) <= t.width {
+			left.nodes = append(left.nodes, last.nodes...)
+			left.rekey()
+			left.size += last.size
+			return level[:n-1]
+		}
+		all := append(append([]*bpNode[K, V](nil), left.nodes...), last.nodes...)
+		half := len(all) / 2
+		left.nodes = append(left.nodes[:0], all[:half]...)
+		last.nodes = append(last.nodes[:0], all[half:]...)
+		left.rekey()
+		last.rekey()
+		left.recount()
+		last.recount()
+		return level
+	}
+
+	if len(last.keys) >= t.halfw {
+		return level
+	}
+	if len(left.keys)+len(last.keys) <= t.width {
+		left.keys = append(left.keys, last.keys...)
+		left.values = append(left.values, last.values...)
+		left.maxKey = last.maxKey
+		left.next = nil
+		t.release(last)
+		return level[:n-1]
+	}
+	keys := append(append([]K(nil), left.keys...), last.keys...)
+	values := append(append([]V(nil), left.values...), last.values...)
+	half := len(keys) / 2
+	left.keys = append(left.keys[:0], keys[:half]...)
+	left.values = append(left.values[:0], values[:half]...)
+	last.keys = append(last.keys[:0], keys[half:]...)
+	last.values = append(last.values[:0], values[half:]...)
+	left.maxKey = left.keys[half-1]
+	return level
+}
@@ -0,0 +1,168 @@
+package bptree
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func sequence(n int) func() (int64, interface{}, bool) {
+	i := 0
+	return func() (int64, interface{}, bool) {
+		if i == n {
+			return 0, nil, false
+		}
+		i++
+		return int64(i * 2), i, true
+	}
+}
+
+// checkShape verifies that every leaf is at the same depth and that every
+// node but the root holds between half of width and width entries.
+func checkShape[K comparable, V any](t *testing.T, tree *Tree[K, V]) {
+	t.Helper()
+	depth := -1
+	var walk func(node *bpNode[K, V], level int)
+	walk = func(node *bpNode[K, V], level int) {
+		n := entries(node)
+		if node != tree.root && (n < tree.halfw || n > tree.width) {
+			t.Fatalf("node at level %d has %d entries, want %d to %d", level, n, tree.halfw, tree.width)
+		}
+		if len(node.nodes) == 0 {
+			if depth == -1 {
+				depth = level
+			} else if depth != level {
+				t.Fatalf("leaves at levels %d and %d", depth, level)
+			}
+		}
+		for _, child := range node.nodes {
+			walk(child, level+1)
+		}
+	}
+	walk(tree.root, 0)
+}
+
+func TestBulkLoad(t *testing.T) {
+	for _, width := range []int{3, 4, 7, 32} {
+		for _, fill := range []float64{0, 0.7, 1} {
+			for _, n := range []int{0, 1, 5, 100, 1001} {
+				tree := NewBPTree(width)
+				if err := tree.BulkLoad(sequence(n), fill); err != nil {
+					t.Fatal(err)
+				}
+				checkShape(t, tree.Tree)
+				if tree.Len() != n {
+					t.Fatalf("width %d fill %v: Len() = %d, want %d", width, fill, tree.Len(), n)
+				}
+
+				i := 0
+				tree.Ascend(0, func(key int64, val interface{}) bool {
+					i++
+					if key != int64(i*2) || val != i {
+						t.Fatalf("width %d fill %v: item %d = %d/%v", width, fill, i, key, val)
+					}
+					return true
+				})
+				if i != n {
+					t.Fatalf("width %d fill %v: ascended %d keys, want %d", width, fill, i, n)
+				}
+
+				// The loaded tree keeps working as usual.
+				tree.Set(3, "odd")
+				if _, val, ok := tree.Ceiling(3); !ok || val != "odd" {
+					t.Fatalf("width %d fill %v: Set after BulkLoad is lost", width, fill)
+				}
+			}
+		}
+	}
+}
+
+func TestBulkLoadErrors(t *testing.T) {
+	keys := []int64{1, 2, 2, 3}
+	i := 0
+	next := func() (int64, interface{}, bool) {
+		if i == len(keys) {
+			return 0, nil, false
+		}
+		i++
+		return keys[i-1], nil, true
+	}
+
+	tree := NewBPTree(4)
+	if err := tree.BulkLoad(next, 1); err != ErrUnsorted {
+		t.Fatalf("err = %v, want %v", err, ErrUnsorted)
+	}
+	if tree.Len() != 0 {
+		t.Fatalf("Len() = %d after a failed load, want 0", tree.Len())
+	}
+
+	tree.Set(1, nil)
+	if err := tree.BulkLoad(sequence(10), 1); err != ErrNotEmpty {
+		t.Fatalf("err = %v, want %v", err, ErrNotEmpty)
+	}
+}
+
+func TestBulkLoadDisk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.db")
+	tree, err := Open(path, stringOptions(8, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := int64(0)
+	err = tree.BulkLoad(func() (int64, string, bool) {
+		i++
+		return i, strconv.FormatInt(i, 10), i <= 5000
+	}, 0.9)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The loaded keys are in the file without closing the tree.
+	reopened, err := Open(path, stringOptions(8, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	data := treeContents(reopened)
+	if len(data) != 5000 || data[4321] != "4321" {
+		t.Fatalf("reopened %d keys, want 5000", len(data))
+	}
+}
+
+func BenchmarkBulkLoad(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		tree := NewBPTree(64)
+		if err := tree.BulkLoad(sequence(1<<20), 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSetSorted(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		tree := NewBPTree(64)
+		next := sequence(1 << 20)
+		for key, val, ok := next(); ok; key, val, ok = next() {
+			tree.Set(key, val)
+		}
+	}
+}
+
+func TestBulkLoadTxnConflict(t *testing.T) {
+	tree := NewBPTree(4)
+	reader, other := tree.Begin(), tree.Begin()
+	if _, ok := reader.Get(50); ok {
+		t.Fatal("key 50 exists before BulkLoad")
+	}
+	other.Get(5000)
+	if err := tree.BulkLoad(sequence(100), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reader.Commit(); err != ErrConflict {
+		t.Fatalf("Commit() after reading a loaded key = %v, want %v", err, ErrConflict)
+	}
+	if err := other.Commit(); err != nil {
+		t.Fatalf("Commit() after reading another key = %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Codec converts keys or values to and from bytes for trees stored on disk.
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+var errCodecLength = errors.New("bptree: encoded value has the wrong length")
+
+// Int64Codec encodes int64s as eight little-endian bytes.
+type Int64Codec struct{}
+
+func (Int64Codec) Encode(v int64) ([]byte, error) {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(v))
+	return buf, nil
+}
+
+func (Int64Codec) Decode(data []byte) (int64, error) {
+	if len(data) != 8 {
+		return 0, errCodecLength
+	}
+	return int64(binary.LittleEndian.Uint64(data)), nil
+}
+
+// StringCodec stores strings as their raw bytes.
+type StringCodec struct{}
+
+func (StringCodec) Encode(v string) ([]byte, error) {
+	return []byte(v), nil
+}
+
+func (StringCodec) Decode(data []byte) (string, error) {
+	return string(data), nil
+}
+
+// BytesCodec stores byte slices unchanged.
+type BytesCodec struct{}
+
+func (BytesCodec) Encode(v []byte) ([]byte, error) {
+	return v, nil
+}
+
+func (BytesCodec) Decode(data []byte) ([]byte, error) {
+	out := make([]byte, len(data))
+	copy(out, data)
+	return out, nil
+}
@@ -0,0 +1,866 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"time"
+)
+
+// Options configures a tree stored in a file by Open.
+type Options[K any, V any] struct {
+	// Width is the maximum number of keys or children per node of a new
+	// file. An existing file keeps the width it was created with.
+	Width int
+
+	// PageSize is the page size of a new file, defaulting to 4096 bytes.
+	// Nodes larger than a page spill into continuation pages.
+	PageSize int
+
+	// Compare orders the keys. It must be the same every time a file is
+	// opened.
+	Compare func(a, b K) int
+
+	KeyCodec   Codec[K]
+	ValueCodec Codec[V]
+
+	// CacheLeaves is the number of leaves kept in memory, defaulting to
+	// 1024.
+	CacheLeaves int
+
+	// Sync decides when the write-ahead log is synced; SyncInterval uses
+	// SyncInterval as the period.
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+
+	// CheckpointSize is the log size in bytes that triggers a checkpoint,
+	// defaulting to 4MB.
+	CheckpointSize int64
+
+	// FS opens the data file and the log, defaulting to the os package.
+	FS FS
+}
+
+// diskStore is the file behind a tree opened with Open.
+type diskStore[K any, V any] struct {
+	pager      pager
+	wal        wal
+	keyCodec   Codec[K]
+	valueCodec Codec[V]
+
+	generation     uint64
+	freeList       []pageID
+	checkpointSize int64
+
+	// The first error writing to disk. Once it is set the tree only
+	// changes in memory, and Flush, Checkpoint and Close return it.
+	err    error
+	closed bool
+}
+
+// Page 0 holds two header slots, which checkpoints write alternately. Each
+// carries a generation number and a checksum, and Open uses the valid slot
+// with the highest generation, so a header torn by a crash is ignored.
+//
+//	magic "BPTP" | version u8 | generation u64 | page size u32 | width u32 |
+//	root u64 | free list u64 | page count u64 | key count u64 | lsn u64 |
+//	crc u32
+const (
+	fileMagic   = "BPTP"
+	fileVersion = 3
+	fileHeader  = 4 + 1 + 8 + 4 + 4 + 8 + 8 + 8 + 8 + 8 + 4
+	headerSlot  = 128
+
+	defaultCheckpointSize = 4 << 20
+)
+
+var (
+	errMissingOption = errors.New("bptree: Compare, KeyCodec and ValueCodec are required")
+	errNoHeader      = errors.New("bptree: no header was written")
+)
+
+type fileHeaderData struct {
+	generation uint64
+	pageSize   int
+	width      int
+	root       pageID
+	freeList   pageID
+	pageCount  uint64
+	count      uint64
+	lsn        uint64
+}
+
+// Open opens the tree stored in the file at path, creating an empty one if
+// the file does not exist. The tree is used through the usual API, but only
+// its index nodes are read into memory up front. Leaves are read from the
+// file when they are first used and kept in a cache of opts.CacheLeaves
+// leaves, as in a spill tree, which also means that readers are serialized
+// and that callbacks and open Iterators must not call into the tree.
+// NewSpillTree describes what happens when a leaf cannot be read.
+//
+// Every Set and Remove is first appended to a write-ahead log in path+".wal"
+// and synced according to opts.Sync. Checkpoint writes the changed nodes to
+// the file and empties the log; on Open the log is replayed on top of the
+// last checkpoint, so a crash loses at most the changes that were not synced.
+func Open[K any, V any](path string, opts Options[K, V]) (*Tree[K, V], error) {
+	if opts.Compare == nil || opts.KeyCodec == nil || opts.ValueCodec == nil {
+		return nil, errMissingOption
+	}
+	fs := opts.FS
+	if fs == nil {
+		fs = osFS{}
+	}
+
+	file, err := fs.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	logFile, err := fs.OpenFile(path + ".wal")
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	tree, err := openTree(file, logFile, opts)
+	if err != nil {
+		file.Close()
+		logFile.Close()
+		return nil, err
+	}
+	return tree, nil
+}
+
+func openTree[K any, V any](file, logFile File, opts Options[K, V]) (*Tree[K, V], error) {
+	store := &diskStore[K, V]{
+		wal: wal{
+			file:     logFile,
+			policy:   opts.Sync,
+			interval: opts.SyncInterval,
+			now:      time.Now,
+		},
+		keyCodec:       opts.KeyCodec,
+		valueCodec:     opts.ValueCodec,
+		checkpointSize: opts.CheckpointSize,
+	}
+	if store.checkpointSize <= 0 {
+		store.checkpointSize = defaultCheckpointSize
+	}
+	store.wal.lastSync = store.wal.now()
+
+	size, err := file.Size()
+	if err != nil {
+		return nil, err
+	}
+	header, err := readFileHeader(file)
+	if err == errNoHeader {
+		// The file is new, or a crash interrupted its first checkpoint
+		// and nothing in it was ever committed.
+		size = 0
+		if err := file.Truncate(0); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		pageSize := opts.PageSize
+		if pageSize == 0 {
+			pageSize = defaultPageSize
+		} else if pageSize < minPageSize {
+			pageSize = minPageSize
+		}
+
+		tree := NewTree[K, V](opts.Width, opts.Compare)
+		store.pager = pager{file: file, pageSize: pageSize, pageCount: 1}
+		tree.attach(store, opts.CacheLeaves)
+		tree.admit(tree.root)
+		if err := store.wal.reset(); err != nil {
+			return nil, err
+		}
+		if err := tree.checkpoint(); err != nil {
+			return nil, err
+		}
+		return tree, nil
+	}
+
+	tree := NewTree[K, V](header.width, opts.Compare)
+	store.pager = pager{file: file, pageSize: header.pageSize, pageCount: header.pageCount}
+	store.generation = header.generation
+	store.wal.lsn = header.lsn
+	tree.attach(store, opts.CacheLeaves)
+
+	root, err := tree.loadRoot(header.root)
+	if err != nil {
+		return nil, err
+	}
+	tree.root, tree.count = root, root.count()
+	if uint64(tree.count) != header.count {
+		return nil, ErrCorrupted
+	}
+	if store.freeList, err = store.pager.readFreeList(header.freeList); err != nil {
+		return nil, err
+	}
+
+	err = store.wal.replay(func(lsn uint64, op byte, key, val []byte) error {
+		if lsn <= header.lsn {
+			return nil
+		}
+		defer tree.evict()
+		return tree.redo(op, key, val)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// attach makes store the file of the tree, and gives the tree a page cache
+// of capacity leaves that loads them through the pager of store. Admitting
+// the root is left to the caller, which may replace it.
+func (t *Tree[K, V]) attach(store *diskStore[K, V], capacity int) {
+	if capacity <= 0 {
+		capacity = defaultCacheLeaves
+	}
+	t.store = store
+	t.cache = &leafCache[K, V]{
+		pager:      &store.pager,
+		keyCodec:   store.keyCodec,
+		valueCodec: store.valueCodec,
+		capacity:   capacity,
+		durable:    true,
+	}
+}
+
+// readFileHeader returns the newest valid header, or errNoHeader if both
+// slots are still blank.
+func readFileHeader(file File) (fileHeaderData, error) {
+	var best fileHeaderData
+	found, blank := false, true
+	for slot := 0; slot < 2; slot++ {
+		buf := make([]byte, fileHeader)
+		n, _ := file.ReadAt(buf, int64(slot*headerSlot))
+		for _, b := range buf[:n] {
+			if b != 0 {
+				blank = false
+			}
+		}
+		if n < fileHeader {
+			continue
+		}
+		if string(buf[:4]) != fileMagic || buf[4] != fileVersion ||
+			crc32.Checksum(buf[:fileHeader-4], crcTable) != binary.LittleEndian.Uint32(buf[fileHeader-4:]) {
+			continue
+		}
+
+		header := fileHeaderData{
+			generation: binary.LittleEndian.Uint64(buf[5:]),
+			pageSize:   int(binary.LittleEndian.Uint32(buf[13:])),
+			width:      int(binary.LittleEndian.Uint32(buf[17:])),
+			root:       binary.LittleEndian.Uint64(buf[21:]),
+			freeList:   binary.LittleEndian.Uint64(buf[29:]),
+			pageCount:  binary.LittleEndian.Uint64(buf[37:]),
+			count:      binary.LittleEndian.Uint64(buf[45:]),
+			lsn:        binary.LittleEndian.Uint64(buf[53:]),
+		}
+		if header.pageSize < minPageSize {
+			continue
+		}
+		if !found || header.generation > best.generation {
+			best, found = header, true
+		}
+	}
+	if !found {
+		if blank {
+			return best, errNoHeader
+		}
+		return best, ErrCorrupted
+	}
+	return best, nil
+}
+
+func (s *diskStore[K, V]) writeFileHeader(header fileHeaderData) error {
+	buf := make([]byte, fileHeader)
+	copy(buf, fileMagic)
+	buf[4] = fileVersion
+	binary.LittleEndian.PutUint64(buf[5:], header.generation)
+	binary.LittleEndian.PutUint32(buf[13:], uint32(header.pageSize))
+	binary.LittleEndian.PutUint32(buf[17:], uint32(header.width))
+	binary.LittleEndian.PutUint64(buf[21:], header.root)
+	binary.LittleEndian.PutUint64(buf[29:], header.freeList)
+	binary.LittleEndian.PutUint64(buf[37:], header.pageCount)
+	binary.LittleEndian.PutUint64(buf[45:], header.count)
+	binary.LittleEndian.PutUint64(buf[53:], header.lsn)
+	binary.LittleEndian.PutUint32(buf[fileHeader-4:], crc32.Checksum(buf[:fileHeader-4], crcTable))
+
+	_, err := s.pager.file.WriteAt(buf, int64(header.generation%2)*headerSlot)
+	return err
+}
+
+// Err returns the first error the tree hit writing to disk, if any. From
+// then on changes are kept in memory only. For a spill tree it is the first
+// error writing to the spill file, after which no more leaves are spilled,
+// or loading a leaf from it. A tree opened from a file reports the errors of
+// its leaves like a spill tree, after those of its log and checkpoints.
+func (t *Tree[K, V]) Err() error {
+	t.rlock()
+	defer t.runlock()
+
+	if t.store != nil && t.store.err != nil {
+		return t.store.err
+	}
+	if t.cache != nil {
+		return t.cache.err
+	}
+	return nil
+}
+
+// Flush syncs the write-ahead log, making every change so far durable. It
+// is a no-op for trees that were not opened from a file.
+func (t *Tree[K, V]) Flush() error {
+	t.lock()
+	defer t.unlock()
+
+	if err := t.storeErr(); err != nil || t.store == nil {
+		return err
+	}
+	t.store.err = t.store.wal.sync()
+	return t.store.err
+}
+
+// Checkpoint writes every node changed since the last checkpoint to the
+// file and empties the write-ahead log.
+func (t *Tree[K, V]) Checkpoint() error {
+	t.lock()
+	defer t.unlock()
+
+	if err := t.storeErr(); err != nil || t.store == nil {
+		return err
+	}
+	t.store.err = t.checkpoint()
+	return t.store.err
+}
+
+// Close checkpoints the tree and closes its files. Closing a spill tree
+// empties and closes the spill file instead. Either way the tree must not be
+// used afterwards, since its leaves can no longer be loaded.
+func (t *Tree[K, V]) Close() error {
+	t.lock()
+	defer t.unlock()
+
+	if t.store == nil {
+		if t.cache != nil {
+			return t.cache.close()
+		}
+		return nil
+	}
+	if t.store.closed {
+		return ErrClosed
+	}
+	err := t.store.err
+	if err == nil {
+		err = t.checkpoint()
+	}
+	t.store.closed = true
+	t.cache.closed = true
+	if cerr := t.store.pager.file.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := t.store.wal.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (t *Tree[K, V]) storeErr() error {
+	if t.store == nil {
+		return nil
+	}
+	if t.store.closed {
+		return ErrClosed
+	}
+	return t.store.err
+}
+
+// checkpoint writes the changed nodes and a new free list to unused pages,
+// commits them with a header in the older slot, and then empties the log.
+func (t *Tree[K, V]) checkpoint() error {
+	s := t.store
+	p := &s.pager
+
+	if err := t.writeNode(t.root); err != nil {
+		return err
+	}
+	p.release(s.freeList...)
+	first, more, err := p.writeFreeList()
+	if err != nil {
+		return err
+	}
+	if err := p.file.Sync(); err != nil {
+		return err
+	}
+
+	header := fileHeaderData{
+		generation: s.generation + 1,
+		pageSize:   p.pageSize,
+		width:      t.width,
+		root:       t.root.page,
+		freeList:   first,
+		pageCount:  p.pageCount,
+		count:      uint64(t.count),
+		lsn:        s.wal.lsn,
+	}
+	if err := s.writeFileHeader(header); err != nil {
+		return err
+	}
+	if err := p.file.Sync(); err != nil {
+		return err
+	}
+
+	s.generation++
+	s.freeList = append([]pageID{first}, more...)
+	p.committed()
+	return s.wal.reset()
+}
+
+// logSet and logRemove append a change to the write-ahead log before it is
+// applied to the tree.
+func (t *Tree[K, V]) logSet(key K, value V) {
+	s := t.store
+	if s == nil || s.closed || s.err != nil {
+		return
+	}
+	k, err := s.keyCodec.Encode(key)
+	if err != nil {
+		s.err = err
+		return
+	}
+	v, err := s.valueCodec.Encode(value)
+	if err != nil {
+		s.err = err
+		return
+	}
+	s.err = s.wal.append(walOpSet, k, v)
+}
+
+func (t *Tree[K, V]) logRemove(key K) {
+	s := t.store
+	if s == nil || s.closed || s.err != nil {
+		return
+	}
+	k, err := s.keyCodec.Encode(key)
+	if err != nil {
+		s.err = err
+		return
+	}
+	s.err = s.wal.append(walOpRemove, k, nil)
+}
+
+func (t *Tree[K, V]) logRemoveRange(lo, hi K) {
+	s := t.store
+	if s == nil || s.closed || s.err != nil {
+		return
+	}
+	k, err := s.keyCodec.Encode(lo)
+	if err != nil {
+		s.err = err
+		return
+	}
+	v, err := s.keyCodec.Encode(hi)
+	if err != nil {
+		s.err = err
+		return
+	}
+	s.err = s.wal.append(walOpRemoveRange, k, v)
+}
+
+// logBatch appends a whole batch as one record, so that a crash keeps
+// either all of its changes or none. The record value holds the count of
+// changes, then each change as its op and length-prefixed key and value.
+func (t *Tree[K, V]) logBatch(ops []batchOp[K, V]) {
+	s := t.store
+	if s == nil || s.closed || s.err != nil {
+		return
+	}
+	buf := appendUvarint(nil, uint64(len(ops)))
+	for _, op := range ops {
+		k, err := s.keyCodec.Encode(op.key)
+		if err != nil {
+			s.err = err
+			return
+		}
+		var v []byte
+		code := walOpRemove
+		if !op.remove {
+			code = walOpSet
+			if v, err = s.valueCodec.Encode(op.value); err != nil {
+				s.err = err
+				return
+			}
+		}
+		buf = append(buf, code)
+		buf = appendUvarint(buf, uint64(len(k)))
+		buf = append(buf, k...)
+		buf = appendUvarint(buf, uint64(len(v)))
+		buf = append(buf, v...)
+	}
+	s.err = s.wal.append(walOpBatch, nil, buf)
+}
+
+// maybeCheckpoint checkpoints once the log has grown past its limit.
+func (t *Tree[K, V]) maybeCheckpoint() {
+	s := t.store
+	if s == nil || s.closed || s.err != nil || s.wal.size < s.checkpointSize {
+		return
+	}
+	s.err = t.checkpoint()
+}
+
+// redo applies a change read back from the log.
+func (t *Tree[K, V]) redo(op byte, key, val []byte) error {
+	if op == walOpBatch {
+		r := &byteReader{buf: val}
+		n := r.uvarint()
+		for i := uint64(0); i < n && r.err == nil; i++ {
+			if len(r.buf) == 0 {
+				return ErrCorrupted
+			}
+			code := r.buf[0]
+			r.buf = r.buf[1:]
+			key, val := r.bytes(), r.bytes()
+			if r.err != nil || code == walOpBatch {
+				return ErrCorrupted
+			}
+			if err := t.redo(code, key, val); err != nil {
+				return err
+			}
+		}
+		if r.err != nil {
+			return ErrCorrupted
+		}
+		return nil
+	}
+
+	k, err := t.store.keyCodec.Decode(key)
+	if err != nil {
+		return ErrCorrupted
+	}
+	switch op {
+	case walOpSet:
+		v, err := t.store.valueCodec.Decode(val)
+		if err != nil {
+			return ErrCorrupted
+		}
+		if err := t.prepare(k, false); err != nil {
+			return err
+		}
+		t.set(k, v)
+	case walOpRemove:
+		if err := t.prepare(k, true); err != nil {
+			return err
+		}
+		t.remove(k, nil)
+	case walOpRemoveRange:
+		hi, err := t.store.keyCodec.Decode(val)
+		if err != nil {
+			return ErrCorrupted
+		}
+		if err := t.prepareRange(k, hi, false); err != nil {
+			return err
+		}
+		t.removeRange(k, hi, nil)
+	default:
+		return ErrCorrupted
+	}
+	return nil
+}
+
+// writeNode writes the subtree of node bottom-up, so that every child has a
+// page by the time its parent is encoded. Changed nodes move to new pages,
+// which in turn changes their parents; clean subtrees are left alone. Dirty
+// leaves that were evicted since the last checkpoint are on new pages
+// already, see evict.
+func (t *Tree[K, V]) writeNode(node *bpNode[K, V]) error {
+	changed := false
+	for _, child := range node.nodes {
+		old, dirty := child.page, child.dirty
+		if err := t.writeNode(child); err != nil {
+			return err
+		}
+		changed = changed || dirty || child.page != old
+	}
+	if node.spilled {
+		node.dirty = false
+		return nil
+	}
+	if !node.dirty && !changed && node.page != 0 {
+		return nil
+	}
+
+	typ, payload, err := t.encodeNode(node)
+	if err != nil {
+		return err
+	}
+	t.releasePages(node)
+	if node.page, node.more, err = t.store.pager.writeChain(typ, payload); err != nil {
+		return err
+	}
+	node.dirty = false
+	return nil
+}
+
+// release frees the pages of a node that was dropped from the tree. The
+// pages stay intact until the next checkpoint commits, and those of a leaf
+// until no snapshot can load it, see dropLeaf.
+func (t *Tree[K, V]) release(node *bpNode[K, V]) {
+	if t.cache != nil && node.leafState != nil {
+		t.dropLeaf(node)
+		return
+	}
+	t.releasePages(node)
+}
+
+// releasePages frees the pages of a node of a file, because it was dropped
+// or is about to be written elsewhere.
+func (t *Tree[K, V]) releasePages(node *bpNode[K, V]) {
+	if t.store == nil || node.page == 0 {
+		return
+	}
+	t.store.pager.release(node.page)
+	t.store.pager.release(node.more...)
+	node.page, node.more = 0, nil
+}
+
+// A leaf is encoded as its item count followed by length-prefixed keys and
+// values. An index node is encoded as its level, 1 if its children are
+// leaves, and its child count, followed for each child by its first page,
+// its continuation pages, its key count and its length-prefixed maxKey.
+// That is all Open needs to build the index nodes without reading the
+// leaves. Numbers are uvarints.
+func (t *Tree[K, V]) encodeNode(node *bpNode[K, V]) (byte, []byte, error) {
+	if len(node.nodes) > 0 {
+		level := 0
+		for n := node; len(n.nodes) > 0; n = n.nodes[0] {
+			level++
+		}
+		buf := appendUvarint(nil, uint64(level))
+		buf = appendUvarint(buf, uint64(len(node.nodes)))
+		for _, child := range node.nodes {
+			key, err := t.store.keyCodec.Encode(child.maxKey)
+			if err != nil {
+				return 0, nil, err
+			}
+			buf = appendUvarint(buf, child.page)
+			buf = appendUvarint(buf, uint64(len(child.more)))
+			for _, id := range child.more {
+				buf = appendUvarint(buf, id)
+			}
+			buf = appendUvarint(buf, uint64(child.count()))
+			buf = appendUvarint(buf, uint64(len(key)))
+			buf = append(buf, key...)
+		}
+		return pageTypeIndex, buf, nil
+	}
+
+	buf := appendUvarint(nil, uint64(len(node.values)))
+	buf, err := appendItems(buf, t.leafKeys(node), node.values, t.store.keyCodec, t.store.valueCodec)
+	if err != nil {
+		return 0, nil, err
+	}
+	return pageTypeLeaf, buf, nil
+}
+
+// appendItems appends keys and values to buf, each prefixed with its
+// length.
+func appendItems[K any, V any](buf []byte, keys []K, values []V, keyCodec Codec[K], valueCodec Codec[V]) ([]byte, error) {
+	for i := range keys {
+		key, err := keyCodec.Encode(keys[i])
+		if err != nil {
+			return nil, err
+		}
+		val, err := valueCodec.Encode(values[i])
+		if err != nil {
+			return nil, err
+		}
+		buf = appendUvarint(buf, uint64(len(key)))
+		buf = append(buf, key...)
+		buf = appendUvarint(buf, uint64(len(val)))
+		buf = append(buf, val...)
+	}
+	return buf, nil
+}
+
+// readItems decodes n items written by appendItems and appends them to keys
+// and values.
+func readItems[K any, V any](r *byteReader, n uint64, keys []K, values []V, keyCodec Codec[K], valueCodec Codec[V]) ([]K, []V, error) {
+	for i := uint64(0); i < n; i++ {
+		key, err := keyCodec.Decode(r.bytes())
+		if r.err != nil || err != nil {
+			return nil, nil, ErrCorrupted
+		}
+		val, err := valueCodec.Decode(r.bytes())
+		if r.err != nil || err != nil {
+			return nil, nil, ErrCorrupted
+		}
+		keys = append(keys, key)
+		values = append(values, val)
+	}
+	return keys, values, nil
+}
+
+// decodeLeaf returns the items of a leaf encoded by encodeNode.
+func decodeLeaf[K any, V any](payload []byte, width int, keyCodec Codec[K], valueCodec Codec[V]) ([]K, []V, error) {
+	r := &byteReader{buf: payload}
+	n := r.uvarint()
+	if r.err != nil || n > uint64(len(payload)) {
+		return nil, nil, ErrCorrupted
+	}
+	return readItems(r, n, make([]K, 0, width+1), make([]V, 0, width+1), keyCodec, valueCodec)
+}
+
+// loadRoot reads the root stored at id. A leaf root is read whole, and an
+// index root with the index nodes below it, see loadIndex.
+func (t *Tree[K, V]) loadRoot(id pageID) (*bpNode[K, V], error) {
+	typ, payload, more, err := t.store.pager.readChain(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var node *bpNode[K, V]
+	switch typ {
+	case pageTypeLeaf:
+		node = allocLeaf[K, V]()
+		node.keys, node.values, err = decodeLeaf(payload, t.width, t.store.keyCodec, t.store.valueCodec)
+		if err == nil && len(node.keys) > 0 {
+			node.maxKey = node.keys[len(node.keys)-1]
+		}
+	case pageTypeIndex:
+		var last *bpNode[K, V]
+		node, _, err = t.decodeIndex(payload, &last)
+	default:
+		err = ErrCorrupted
+	}
+	if err != nil {
+		return nil, err
+	}
+	node.page, node.more = id, more
+	if typ == pageTypeLeaf {
+		t.admit(node)
+	}
+	return node, nil
+}
+
+// loadIndex reads the index node stored at id, which must be at level.
+func (t *Tree[K, V]) loadIndex(id pageID, level uint64, last **bpNode[K, V]) (*bpNode[K, V], error) {
+	typ, payload, more, err := t.store.pager.readChain(id)
+	if err != nil {
+		return nil, err
+	}
+	if typ != pageTypeIndex {
+		return nil, ErrCorrupted
+	}
+	node, got, err := t.decodeIndex(payload, last)
+	if err != nil {
+		return nil, err
+	}
+	if got != level {
+		return nil, ErrCorrupted
+	}
+	node.page, node.more = id, more
+	return node, nil
+}
+
+// decodeIndex builds an index node and the index nodes below it from the
+// payload of its page, and returns it with its level. The leaves are not
+// read: they are created spilled from what the index page records, and
+// loaded when they are first used. They are linked in the order they are
+// created, with last tracking the previous one.
+func (t *Tree[K, V]) decodeIndex(payload []byte, last **bpNode[K, V]) (*bpNode[K, V], uint64, error) {
+	r := &byteReader{buf: payload}
+	level := r.uvarint()
+	n := r.uvarint()
+	if r.err != nil || level == 0 || level > 64 || n == 0 || n > uint64(len(payload)) {
+		return nil, 0, ErrCorrupted
+	}
+
+	p := &t.store.pager
+	node := newIndexNode[K, V](t.width)
+	for i := uint64(0); i < n; i++ {
+		id := r.uvarint()
+		var more []pageID
+		m := r.uvarint()
+		if r.err != nil || m > p.pageCount {
+			return nil, 0, ErrCorrupted
+		}
+		for j := uint64(0); j < m; j++ {
+			page := r.uvarint()
+			if page == 0 || page >= p.pageCount {
+				return nil, 0, ErrCorrupted
+			}
+			more = append(more, page)
+		}
+		count := r.uvarint()
+		key, err := t.store.keyCodec.Decode(r.bytes())
+		if r.err != nil || err != nil || count == 0 {
+			return nil, 0, ErrCorrupted
+		}
+
+		var child *bpNode[K, V]
+		if level > 1 {
+			if child, err = t.loadIndex(id, level-1, last); err != nil {
+				return nil, 0, err
+			}
+			if uint64(child.count()) != count {
+				return nil, 0, ErrCorrupted
+			}
+		} else {
+			if id == 0 || id >= p.pageCount {
+				return nil, 0, ErrCorrupted
+			}
+			child = allocLeaf[K, V]()
+			child.page, child.more = id, more
+			child.size, child.maxKey = int64(count), key
+			child.spilled = true
+			if *last != nil {
+				(*last).next = child
+				child.prev = *last
+			}
+			*last = child
+		}
+		node.nodes = append(node.nodes, child)
+	}
+	node.rekey()
+	node.recount()
+	return node, level, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+type byteReader struct {
+	buf []byte
+	err error
+}
+
+func (r *byteReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = ErrCorrupted
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *byteReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil || n > uint64(len(r.buf)) {
+		r.err = ErrCorrupted
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
@@ -0,0 +1,227 @@
+package bptree
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func stringOptions(width, pageSize int) Options[int64, string] {
+	return Options[int64, string]{
+		Width:      width,
+		PageSize:   pageSize,
+		Compare:    Compare[int64],
+		KeyCodec:   Int64Codec{},
+		ValueCodec: StringCodec{},
+	}
+}
+
+func treeContents[K comparable, V any](tree *Tree[K, V]) map[K]V {
+	data := make(map[K]V)
+	it := tree.Iterator()
+	defer it.Close()
+	for ok := it.First(); ok; ok = it.Next() {
+		data[it.Key()] = it.Value()
+	}
+	return data
+}
+
+func TestOpenReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.db")
+	tree, err := Open(path, stringOptions(8, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	model := make(map[int64]string)
+	for i := 0; i < 2000; i++ {
+		key := rand.Int63n(5000)
+		val := strings.Repeat("v", rand.Intn(20))
+		tree.Set(key, val)
+		model[key] = val
+		if i == 1000 {
+			// Checkpointing midway leaves both clean and dirty nodes.
+			if err := tree.Checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Flush(); err != ErrClosed {
+		t.Fatalf("Flush after Close: err = %v, want %v", err, ErrClosed)
+	}
+
+	reopened, err := Open(path, stringOptions(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if reopened.Len() != len(model) {
+		t.Fatalf("Len() = %d, want %d", reopened.Len(), len(model))
+	}
+	got := treeContents(reopened)
+	for key, val := range model {
+		if got[key] != val {
+			t.Fatalf("key %d = %q, want %q", key, got[key], val)
+		}
+	}
+	if reopened.width != 8 {
+		t.Fatalf("width = %d, want the width the file was created with", reopened.width)
+	}
+}
+
+func TestOpenOverflowPages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.db")
+	tree, err := Open(path, stringOptions(4, minPageSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Values far larger than a page make every leaf a chain of pages.
+	for i := int64(0); i < 50; i++ {
+		tree.Set(i, strings.Repeat(string(rune('a'+i%26)), 1000))
+	}
+	if err := tree.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	grown := tree.store.pager.pageCount
+
+	// Shrinking the values frees the continuation pages, and growing them
+	// again reuses those pages instead of extending the file.
+	for i := int64(0); i < 50; i++ {
+		tree.Set(i, "small")
+	}
+	if err := tree.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.store.pager.free) == 0 {
+		t.Fatal("shrunk nodes must free their continuation pages")
+	}
+	for i := int64(0); i < 50; i++ {
+		tree.Set(i, strings.Repeat("z", 1000))
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The old and new versions of the nodes coexist until the checkpoint
+	// commits, so the file grows a little, but far less than it would
+	// without reusing the freed pages.
+	t.Logf("pages: %d after growing, %d after growing again", grown, tree.store.pager.pageCount)
+	if tree.store.pager.pageCount > grown+grown/2 {
+		t.Fatalf("page count = %d, want at most %d after reusing freed pages", tree.store.pager.pageCount, grown+grown/2)
+	}
+
+	reopened, err := Open(path, stringOptions(4, minPageSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	for key, val := range treeContents(reopened) {
+		if val != strings.Repeat("z", 1000) {
+			t.Fatalf("key %d has a damaged value of length %d", key, len(val))
+		}
+	}
+}
+
+func TestOpenLazy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.db")
+	opts := stringOptions(4, minPageSize)
+	opts.CacheLeaves = 4
+	tree, err := Open(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With 4 leaves in memory, most writes evict a dirty leaf to a new page
+	// before the checkpoint writes its parent.
+	model := make(map[int64]string)
+	for i := 0; i < 2000; i++ {
+		key := rand.Int63n(1000)
+		if rand.Intn(4) == 0 {
+			tree.Remove(key)
+			delete(model, key)
+		} else {
+			tree.Set(key, strconv.Itoa(i))
+			model[key] = strconv.Itoa(i)
+		}
+		if i%500 == 0 {
+			if err := tree.Checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	checkSpilled(t, tree)
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if n := reopened.cache.lru.Len(); n != 0 {
+		t.Fatalf("Open read %d leaves, want none", n)
+	}
+	if reopened.Len() != len(model) {
+		t.Fatalf("Len() = %d, want %d", reopened.Len(), len(model))
+	}
+	if got := treeContents(reopened); !reflect.DeepEqual(got, model) {
+		t.Fatalf("reopened tree holds %d keys, want %d", len(got), len(model))
+	}
+	checkSpilled(t, reopened)
+
+	// A snapshot keeps the pages of the leaves it may still load until it
+	// closes, even across checkpoints that reuse the pages freed before
+	// them. RemoveRange drops most leaves without loading them.
+	snap := reopened.Snapshot()
+	reopened.RemoveRange(0, 800)
+	for i := int64(0); i < 800; i++ {
+		reopened.Set(i, "b")
+		if i%50 == 0 {
+			if err := reopened.Checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	n := 0
+	snap.Ascend(0, func(key int64, val string) bool {
+		if val != model[key] {
+			t.Fatalf("snapshot: %d = %q, want %q", key, val, model[key])
+		}
+		n++
+		return true
+	})
+	if n != len(model) {
+		t.Fatalf("snapshot holds %d keys, want %d", n, len(model))
+	}
+	snap.Close()
+	checkSpilled(t, reopened)
+}
+
+func TestOpenErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Open(filepath.Join(dir, "a.db"), Options[int64, string]{}); err != errMissingOption {
+		t.Fatalf("err = %v, want %v", err, errMissingOption)
+	}
+
+	path := filepath.Join(dir, "garbage.db")
+	if err := os.WriteFile(path, []byte("this is not a tree file at all, not even close"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, stringOptions(4, 0)); err != ErrCorrupted {
+		t.Fatalf("err = %v, want %v", err, ErrCorrupted)
+	}
+
+	// A memory tree has nothing to flush.
+	if err := NewBPTree(4).Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,127 @@
+package bptree
+
+import "encoding/binary"
+
+// Integer is the set of integer types, whose keys Freeze can pack.
+type Integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+// keyPacker packs the keys of frozen leaves. A tree gets one from Freeze,
+// which knows that its keys are integers.
+type keyPacker[K any] struct {
+	pack   func(buf []byte, keys []K) []byte
+	unpack func(keys []K, buf []byte, n int) []K
+	find   func(buf []byte, n int, key K, cmp func(a, b K) int) int
+}
+
+// Freeze packs the leaves of a tree with integer keys into a compact frozen
+// form, for trees that are mostly read. A frozen leaf stores its keys as
+// varints of the difference to the previous key, which takes a byte or two
+// per key when keys are dense, and trims the spare room kept for inserts.
+//
+// Frozen leaves are read in place: Get scans the packed keys, which costs
+// more than a binary search in wide leaves, and other reads unpack them into
+// a temporary array. Writing to a frozen leaf thaws it back to the regular
+// form, so after Freeze only the leaves that are written to again take up
+// their full size. Call Freeze again to pack them.
+//
+// Leaves shared with open snapshots are copied rather than packed in place,
+// and spilled leaves are left as they are.
+func Freeze[K Integer, V any](t *Tree[K, V]) {
+	t.lock()
+	defer t.unlock()
+
+	t.packer = &keyPacker[K]{pack: packKeys[K], unpack: unpackKeys[K], find: findPacked[K]}
+	t.root = t.mutable(t.root)
+	t.freezeNode(t.root)
+}
+
+func (t *Tree[K, V]) freezeNode(node *bpNode[K, V]) {
+	if len(node.nodes) == 0 {
+		if len(node.keys) > 0 {
+			node.packed = append([]byte(nil), t.packer.pack(nil, node.keys)...)
+			node.values = append(make([]V, 0, len(node.values)), node.values...)
+			node.keys = nil
+		}
+		return
+	}
+	for i, child := range node.nodes {
+		if len(child.nodes) > 0 || child.packed == nil && !child.spilled {
+			t.freezeNode(t.mutableChild(node, i))
+		}
+	}
+}
+
+// thaw turns a frozen leaf back into the regular form before it changes.
+func (t *Tree[K, V]) thaw(node *bpNode[K, V]) {
+	node.keys = t.appendKeys(make([]K, 0, t.width+1), node)
+	node.values = append(make([]V, 0, t.width+1), node.values...)
+	node.packed = nil
+}
+
+// leafKeys returns the keys of a leaf, unpacking them if it is frozen.
+func (t *Tree[K, V]) leafKeys(node *bpNode[K, V]) []K {
+	if node.packed == nil {
+		return node.keys
+	}
+	return t.appendKeys(make([]K, 0, len(node.values)), node)
+}
+
+func (t *Tree[K, V]) appendKeys(keys []K, node *bpNode[K, V]) []K {
+	if node.packed == nil {
+		return append(keys, node.keys...)
+	}
+	return t.packer.unpack(keys, node.packed, len(node.values))
+}
+
+// find returns the index of key in a leaf, or -1 if it is not there.
+func (t *Tree[K, V]) find(node *bpNode[K, V], key K) int {
+	if node.packed == nil {
+		return node.findItem(t.cmp, key)
+	}
+	return t.packer.find(node.packed, len(node.values), key, t.cmp)
+}
+
+// packKeys appends each key as the zigzag varint of its difference to the
+// previous key. Differences wrap around like the integers themselves, so
+// keys in any order round-trip, but ascending keys that are close together
+// pack best.
+func packKeys[K Integer](buf []byte, keys []K) []byte {
+	var prev K
+	for _, key := range keys {
+		d := int64(key - prev)
+		buf = appendUvarint(buf, uint64(d<<1)^uint64(d>>63))
+		prev = key
+	}
+	return buf
+}
+
+func unpackKeys[K Integer](keys []K, buf []byte, n int) []K {
+	var key K
+	for i := 0; i < n; i++ {
+		u, w := binary.Uvarint(buf)
+		buf = buf[w:]
+		key += K(int64(u>>1) ^ -int64(u&1))
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// findPacked scans packed keys for key, stopping at the first greater one.
+func findPacked[K Integer](buf []byte, n int, key K, cmp func(a, b K) int) int {
+	var k K
+	for i := 0; i < n; i++ {
+		u, w := binary.Uvarint(buf)
+		buf = buf[w:]
+		k += K(int64(u>>1) ^ -int64(u&1))
+		if c := cmp(k, key); c >= 0 {
+			if c == 0 {
+				return i
+			}
+			return -1
+		}
+	}
+	return -1
+}
@@ -0,0 +1,327 @@
+package bptree
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// checkFrozen verifies the tree and that it has want frozen leaves, or that
+// all leaves are frozen if want is -1.
+func checkFrozen[K comparable, V any](t *testing.T, tree *Tree[K, V], want int) {
+	t.Helper()
+	if err := tree.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	s := tree.Stats()
+	if want == -1 {
+		want = s.Nodes[len(s.Nodes)-1]
+	}
+	if s.Frozen != want {
+		t.Fatalf("%d of %d leaves are frozen, want %d", s.Frozen, s.Nodes[len(s.Nodes)-1], want)
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	tree := NewOrderedTree[int64, string](8)
+	rng := rand.New(rand.NewSource(7))
+	model := make(map[int64]string)
+	for i := 0; i < 2000; i++ {
+		key := rng.Int63n(10000)
+		tree.Set(key, fmt.Sprint(i))
+		model[key] = fmt.Sprint(i)
+	}
+	keys := make([]int64, 0, len(model))
+	for key := range model {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	Freeze(tree)
+	checkFrozen(t, tree, -1)
+	if got := treeContents(tree); !reflect.DeepEqual(got, model) {
+		t.Fatalf("frozen tree holds %d keys, want %d", len(got), len(model))
+	}
+	for key := int64(-1); key <= 10000; key++ {
+		if got := tree.Get(key); got != model[key] {
+			t.Fatalf("Get(%d) = %q, want %q", key, got, model[key])
+		}
+	}
+	for i, key := range keys {
+		if got, _, _ := tree.Select(i); got != key {
+			t.Fatalf("Select(%d) = %d, want %d", i, got, key)
+		}
+		if got := tree.Rank(key + 1); got != i+1 {
+			t.Fatalf("Rank(%d) = %d, want %d", key+1, got, i+1)
+		}
+		want := key
+		if i+1 < len(keys) && keys[i+1] == key+1 {
+			want = key + 1
+		}
+		if got, _, _ := tree.Floor(key + 1); got != want {
+			t.Fatalf("Floor(%d) = %d, want %d", key+1, got, want)
+		}
+		want = key
+		if i > 0 && keys[i-1] == key-1 {
+			want = key - 1
+		}
+		if got, _, _ := tree.Ceiling(key - 1); got != want {
+			t.Fatalf("Ceiling(%d) = %d, want %d", key-1, got, want)
+		}
+	}
+	var desc []int64
+	tree.Descend(math.MaxInt64, func(key int64, _ string) bool {
+		desc = append(desc, key)
+		return true
+	})
+	for i, key := range desc {
+		if key != keys[len(keys)-1-i] {
+			t.Fatalf("Descend visited %d at %d, want %d", key, i, keys[len(keys)-1-i])
+		}
+	}
+
+	// Writes thaw the leaves they touch and leave the others frozen.
+	frozen := tree.Stats().Frozen
+	tree.Set(keys[0], "first")
+	model[keys[0]] = "first"
+	checkFrozen(t, tree, frozen-1)
+
+	for op := 0; op < 2000; op++ {
+		key := rng.Int63n(10000)
+		if rng.Intn(2) == 0 {
+			tree.Set(key, "x")
+			model[key] = "x"
+		} else {
+			tree.Remove(key)
+			delete(model, key)
+		}
+	}
+	tree.RemoveRange(2000, 3000)
+	for key := int64(2000); key <= 3000; key++ {
+		delete(model, key)
+	}
+	if err := tree.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	if got := treeContents(tree); !reflect.DeepEqual(got, model) {
+		t.Fatalf("tree holds %d keys after writes, want %d", len(got), len(model))
+	}
+
+	Freeze(tree)
+	checkFrozen(t, tree, -1)
+	if got := treeContents(tree); !reflect.DeepEqual(got, model) {
+		t.Fatalf("refrozen tree holds %d keys, want %d", len(got), len(model))
+	}
+}
+
+func TestFreezeSnapshot(t *testing.T) {
+	tree, _ := randomTree(8, 1000)
+	snap := tree.Snapshot()
+	want := snapshotContents(snap, math.MinInt64)
+
+	// Freezing copies the leaves the snapshot shares, so reading the
+	// snapshot meanwhile does not race with it.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if got := snapshotContents(snap, math.MinInt64); !reflect.DeepEqual(got, want) {
+			t.Errorf("snapshot changed while the tree froze")
+		}
+	}()
+	Freeze(tree.Tree)
+	wg.Wait()
+	checkFrozen(t, tree.Tree, -1)
+
+	var walk func(node *bpNode[int64, interface{}])
+	walk = func(node *bpNode[int64, interface{}]) {
+		if len(node.nodes) == 0 && node.packed != nil {
+			t.Fatal("Freeze packed a leaf shared with a snapshot")
+		}
+		for _, child := range node.nodes {
+			walk(child)
+		}
+	}
+	walk(snap.root)
+
+	// A snapshot of the frozen tree shares frozen leaves, and writers thaw
+	// copies of them.
+	snap.Close()
+	snap = tree.Snapshot()
+	defer snap.Close()
+	for key := range want {
+		tree.Remove(key)
+	}
+	if tree.Len() != 0 {
+		t.Fatalf("Len() = %d, want 0", tree.Len())
+	}
+	if got := snapshotContents(snap, math.MinInt64); !reflect.DeepEqual(got, want) {
+		t.Fatalf("snapshot of the frozen tree holds %d keys, want %d", len(got), len(want))
+	}
+	for key, val := range want {
+		if got, ok := snap.Get(key); !ok || got != val {
+			t.Fatalf("snapshot Get(%d) = %v, %v, want %v", key, got, ok, val)
+		}
+	}
+}
+
+func TestFreezeStores(t *testing.T) {
+	t.Run("multimap", func(t *testing.T) {
+		tree := NewMultiTree[int, int](4, Compare[int])
+		for i := 0; i < 100; i++ {
+			tree.Add(i/10, i)
+		}
+		Freeze(tree)
+		checkFrozen(t, tree, -1)
+		if got := tree.GetAll(5); !reflect.DeepEqual(got, []int{50, 51, 52, 53, 54, 55, 56, 57, 58, 59}) {
+			t.Fatalf("GetAll(5) = %v", got)
+		}
+		tree.Add(5, 100)
+		if got := tree.GetAll(5); len(got) != 11 || got[10] != 100 {
+			t.Fatalf("GetAll(5) = %v after Add", got)
+		}
+	})
+
+	t.Run("reversed", func(t *testing.T) {
+		tree := NewTree[uint8, int](4, func(a, b uint8) int { return Compare(b, a) })
+		for i := 0; i < 256; i += 3 {
+			tree.Set(uint8(i), i)
+		}
+		Freeze(tree)
+		checkFrozen(t, tree, -1)
+		if tree.Get(255) != 255 || tree.Get(0) != 0 || tree.Get(1) != 0 {
+			t.Fatal("Get on a frozen tree with a reversed order")
+		}
+		if key, _, _ := tree.Min(); key != 255 {
+			t.Fatalf("Min() = %d, want 255", key)
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "tree.db")
+		tree, err := Open(path, stringOptions(8, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(0); i < 500; i++ {
+			tree.Set(i*i, fmt.Sprint(i))
+		}
+		Freeze(tree)
+		tree.Set(1, "one")
+		want := treeContents(tree)
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if tree, err = Open(path, stringOptions(8, 0)); err != nil {
+			t.Fatal(err)
+		}
+		defer tree.Close()
+		if got := treeContents(tree); !reflect.DeepEqual(got, want) {
+			t.Fatalf("reopened tree holds %d keys, want %d", len(got), len(want))
+		}
+	})
+
+	t.Run("spill", func(t *testing.T) {
+		tree, err := NewSpillTree(filepath.Join(t.TempDir(), "spill"), spillOptions(4, 4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tree.Close()
+		model := make(map[int64]string)
+		for i := int64(0); i < 500; i++ {
+			tree.Set(i, fmt.Sprint(i))
+			model[i] = fmt.Sprint(i)
+		}
+		Freeze(tree)
+		for i := int64(0); i < 500; i += 7 {
+			tree.Set(i, "x")
+			model[i] = "x"
+		}
+		checkSpilled(t, tree)
+		if got := treeContents(tree); !reflect.DeepEqual(got, model) {
+			t.Fatalf("spill tree holds %d keys, want %d", len(got), len(model))
+		}
+	})
+}
+
+func TestPackKeys(t *testing.T) {
+	ints := []int8{-128, 127, 0, -1, -1, 5, -128}
+	if got := unpackKeys[int8](nil, packKeys(nil, ints), len(ints)); !reflect.DeepEqual(got, ints) {
+		t.Fatalf("int8 keys unpack to %v, want %v", got, ints)
+	}
+	uints := []uint64{0, 1 << 63, math.MaxUint64, 5, math.MaxUint64 - 1}
+	if got := unpackKeys[uint64](nil, packKeys(nil, uints), len(uints)); !reflect.DeepEqual(got, uints) {
+		t.Fatalf("uint64 keys unpack to %v, want %v", got, uints)
+	}
+
+	dense := make([]int64, 1000)
+	for i := range dense {
+		dense[i] = 1e12 + int64(i)
+	}
+	buf := packKeys(nil, dense)
+	if len(buf) > len(dense)+8 {
+		t.Fatalf("%d dense keys take %d bytes", len(dense), len(buf))
+	}
+	for i, key := range []int64{1e12, 1e12 + 500, 1e12 + 999} {
+		if got := findPacked(buf, len(dense), key, Compare[int64]); got != []int{0, 500, 999}[i] {
+			t.Fatalf("findPacked(%d) = %d", key, got)
+		}
+	}
+	for _, key := range []int64{0, 1e12 - 1, 1e12 + 1000} {
+		if got := findPacked(buf, len(dense), key, Compare[int64]); got != -1 {
+			t.Fatalf("findPacked(%d) = %d, want -1", key, got)
+		}
+	}
+}
+
+func BenchmarkGetFrozen(b *testing.B) {
+	keys := rand.New(rand.NewSource(1)).Perm(1 << 16)
+	for _, width := range benchWidths {
+		tree := NewOrderedTree[int, int](width)
+		for _, key := range keys {
+			tree.Set(key, key)
+		}
+		Freeze(tree)
+		b.Run(fmt.Sprintf("width=%d", width), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				tree.Get(keys[i&(len(keys)-1)])
+			}
+		})
+	}
+}
+
+// BenchmarkMemory reports the heap taken per key by a tree filled in random
+// order, before and after freezing it.
+func BenchmarkMemory(b *testing.B) {
+	keys := rand.New(rand.NewSource(1)).Perm(1 << 16)
+	for _, width := range []int{16, 64, 256} {
+		for _, frozen := range []bool{false, true} {
+			b.Run(fmt.Sprintf("width=%d/frozen=%v", width, frozen), func(b *testing.B) {
+				var tree *Tree[int, int]
+				var before, after runtime.MemStats
+				for i := 0; i < b.N; i++ {
+					tree = nil
+					runtime.GC()
+					runtime.ReadMemStats(&before)
+					tree = NewOrderedTree[int, int](width)
+					for _, key := range keys {
+						tree.Set(key, key)
+					}
+					if frozen {
+						Freeze(tree)
+					}
+					runtime.GC()
+					runtime.ReadMemStats(&after)
+				}
+				runtime.KeepAlive(tree)
+				b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(len(keys)), "bytes/key")
+			})
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package bptree
+
+import (
+	"io"
+	"os"
+)
+
+// File is the subset of *os.File a disk tree needs.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Truncate(size int64) error
+	Size() (int64, error)
+	Close() error
+}
+
+// FS opens the files of a disk tree, creating them if they do not exist.
+// It can be replaced to inject faults in tests.
+type FS interface {
+	OpenFile(name string) (File, error)
+}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string) (File, error) {
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{file}, nil
+}
+
+type osFile struct {
+	*os.File
+}
+
+func (f osFile) Size() (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,124 @@
+package bptree
+
+import "fmt"
+
+// CheckInvariants verifies the structure of the tree and returns an error
+// describing the first violation it finds. It checks that keys ascend
+// within and across nodes, that every maxKey is the largest key below it
+// and that index nodes hold the maxKeys of their children,
+// that every node but the root holds between half of width and width
+// entries with all leaves at the same depth, that the leaf chain links the
+// leaves in order in both directions, and that Len and the key counts of
+// index nodes match the keys below them.
+//
+// It walks the whole tree holding the write lock, so that writers do not
+// change it meanwhile, and is meant for tests and debugging.
+func (t *Tree[K, V]) CheckInvariants() error {
+	t.lock()
+	defer t.unlock()
+
+	c := &checker[K, V]{tree: t, depth: -1}
+	if len(t.root.nodes) == 1 {
+		return fmt.Errorf("bptree: index root has a single child")
+	}
+	if err := c.check(t.root, 0); err != nil {
+		return err
+	}
+	if c.last != nil && c.last.next != nil {
+		return fmt.Errorf("bptree: last leaf links to a next leaf")
+	}
+	if c.count != t.count {
+		return fmt.Errorf("bptree: Len is %d but the leaves hold %d keys", t.count, c.count)
+	}
+	return nil
+}
+
+type checker[K any, V any] struct {
+	tree  *Tree[K, V]
+	depth int
+	count int
+
+	// The previous leaf and its last key. Its items may have been spilled
+	// since.
+	last    *bpNode[K, V]
+	lastKey K
+}
+
+func (c *checker[K, V]) check(node *bpNode[K, V], depth int) error {
+	t := c.tree
+	n := entries(node)
+	if node != t.root && (n < t.halfw || n > t.width) {
+		return fmt.Errorf("bptree: node at depth %d has %d entries, want %d to %d", depth, n, t.halfw, t.width)
+	}
+	if (len(node.nodes) > 0) == (node.leafState != nil) {
+		return fmt.Errorf("bptree: node at depth %d has both children and items, or neither", depth)
+	}
+
+	if len(node.nodes) > 0 {
+		if len(node.keys) != len(node.nodes) {
+			return fmt.Errorf("bptree: index node at depth %d has %d keys for %d children", depth, len(node.keys), len(node.nodes))
+		}
+		for i, child := range node.nodes {
+			if i > 0 && !c.ordered(node.nodes[i-1].maxKey, child.maxKey) {
+				return fmt.Errorf("bptree: children at depth %d are out of order at %v", depth+1, child.maxKey)
+			}
+			if t.cmp(node.keys[i], child.maxKey) != 0 {
+				return fmt.Errorf("bptree: index key %v, want the child's maxKey %v", node.keys[i], child.maxKey)
+			}
+			if err := c.check(child, depth+1); err != nil {
+				return err
+			}
+		}
+		if last := node.nodes[len(node.nodes)-1]; t.cmp(node.maxKey, last.maxKey) != 0 {
+			return fmt.Errorf("bptree: index maxKey %v, want %v", node.maxKey, last.maxKey)
+		}
+		size := 0
+		for _, child := range node.nodes {
+			size += child.count()
+		}
+		if n := node.count(); n != size {
+			return fmt.Errorf("bptree: index node at %v counts %d keys, want %d", node.maxKey, n, size)
+		}
+		return nil
+	}
+
+	t.pin(node)
+	defer t.unpin(node)
+	keys := t.leafKeys(node)
+	if len(keys) != len(node.values) {
+		return fmt.Errorf("bptree: leaf at %v has %d keys for %d values", node.maxKey, len(keys), len(node.values))
+	}
+	if c.depth == -1 {
+		c.depth = depth
+	} else if c.depth != depth {
+		return fmt.Errorf("bptree: leaves at depths %d and %d", c.depth, depth)
+	}
+	if node.prev != c.last || (c.last != nil && c.last.next != node) {
+		return fmt.Errorf("bptree: leaf chain is broken before the leaf at %v", node.maxKey)
+	}
+	if c.last != nil && len(keys) > 0 && !c.ordered(c.lastKey, keys[0]) {
+		return fmt.Errorf("bptree: key %v follows a larger or equal key in the previous leaf", keys[0])
+	}
+	for i := 1; i < len(keys); i++ {
+		if !c.ordered(keys[i-1], keys[i]) {
+			return fmt.Errorf("bptree: key %v follows a larger or equal key in its leaf", keys[i])
+		}
+	}
+	if len(keys) > 0 && t.cmp(node.maxKey, keys[len(keys)-1]) != 0 {
+		return fmt.Errorf("bptree: leaf maxKey %v, want %v", node.maxKey, keys[len(keys)-1])
+	}
+
+	c.last = node
+	if len(keys) > 0 {
+		c.lastKey = keys[len(keys)-1]
+	}
+	c.count += len(keys)
+	return nil
+}
+
+// ordered reports whether b may follow a: it must be greater, or equal in
+// a multimap tree.
+func (c *checker[K, V]) ordered(a, b K) bool {
+	r := c.tree.cmp(a, b)
+	return r < 0 || r == 0 && c.tree.multi
+}
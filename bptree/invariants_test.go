@@ -0,0 +1,131 @@
+package bptree
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// runModel interprets data as operations on a tree and on a map, and
+// reports the first point where they diverge or the tree breaks an
+// invariant. The first byte picks the width; then every two bytes are an
+// operation and a key.
+func runModel(t *testing.T, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	tree := NewOrderedTree[int64, int](3 + int(data[0]%8))
+	model := make(map[int64]int)
+	data = data[1:]
+
+	for i := 0; i+1 < len(data); i += 2 {
+		key := int64(data[i+1])
+		switch data[i] % 4 {
+		case 0, 1:
+			tree.Set(key, i)
+			model[key] = i
+		case 2:
+			tree.Remove(key)
+			delete(model, key)
+		case 3:
+			want, ok := model[key]
+			if got := tree.Get(key); ok && got != want || !ok && got != 0 {
+				t.Fatalf("op %d: Get(%d) = %d, want %d", i/2, key, got, want)
+			}
+		}
+		if err := tree.CheckInvariants(); err != nil {
+			t.Fatalf("op %d: %v", i/2, err)
+		}
+		if tree.Len() != len(model) {
+			t.Fatalf("op %d: Len() = %d, want %d", i/2, tree.Len(), len(model))
+		}
+	}
+
+	for key, want := range model {
+		if got := tree.Get(key); got != want {
+			t.Fatalf("Get(%d) = %d, want %d", key, got, want)
+		}
+	}
+	n := 0
+	tree.Ascend(0, func(key int64, val int) bool {
+		if model[key] != val {
+			t.Fatalf("Ascend: key %d = %d, want %d", key, val, model[key])
+		}
+		n++
+		return true
+	})
+	if n != len(model) {
+		t.Fatalf("Ascend visited %d keys, want %d", n, len(model))
+	}
+}
+
+func FuzzTree(f *testing.F) {
+	f.Add([]byte{0, 0, 1, 0, 2, 0, 3, 2, 1, 3, 1})
+	f.Add([]byte{1, 0, 5, 0, 3, 0, 9, 0, 7, 2, 3, 2, 5, 2, 7, 2, 9})
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 8; i++ {
+		seed := make([]byte, 1+2*rng.Intn(500))
+		rng.Read(seed)
+		f.Add(seed)
+	}
+	f.Fuzz(runModel)
+}
+
+func TestModel(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	runs := 200
+	if testing.Short() {
+		runs = 20
+	}
+	for i := 0; i < runs; i++ {
+		data := make([]byte, 1+2*rng.Intn(2000))
+		rng.Read(data)
+		// Skew towards sets first and removes later, so that trees grow
+		// several levels deep and then shrink back.
+		for j := 1; j+1 < len(data); j += 2 {
+			if j < len(data)/2 {
+				data[j] &^= 2
+			} else if rng.Intn(2) == 0 {
+				data[j] = 2
+			}
+		}
+		runModel(t, data)
+	}
+}
+
+func TestCheckInvariants(t *testing.T) {
+	tree, _ := randomTree(4, 200)
+	if err := tree.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+
+	leaf := tree.root
+	for len(leaf.nodes) > 0 {
+		leaf = leaf.nodes[0]
+	}
+	leaf.keys[0], leaf.keys[1] = leaf.keys[1], leaf.keys[0]
+	if err := tree.CheckInvariants(); err == nil {
+		t.Fatal("swapped keys were not detected")
+	}
+	leaf.keys[0], leaf.keys[1] = leaf.keys[1], leaf.keys[0]
+
+	parent := tree.root
+	for len(parent.nodes[0].nodes) > 0 {
+		parent = parent.nodes[0]
+	}
+	parent.keys[0]++
+	if err := tree.CheckInvariants(); err == nil {
+		t.Fatal("a stale index key was not detected")
+	}
+	parent.keys[0]--
+
+	leaf.next.prev = nil
+	if err := tree.CheckInvariants(); err == nil {
+		t.Fatal("a broken leaf chain was not detected")
+	}
+	leaf.next.prev = leaf
+
+	tree.count++
+	if err := tree.CheckInvariants(); err == nil {
+		t.Fatal("a wrong count was not detected")
+	}
+}
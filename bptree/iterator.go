@@ -0,0 +1,174 @@
+package bptree
+
+// Iterator is a cursor over the keys of a Tree in sorted order.
+//
+// An Iterator holds the tree's read lock from its creation until Close, so
+// the shape of the tree stays as it is. Writers that split or merge nodes
+// block in the meantime, while others may still change leaves, see Tree.
+// The iterator copies the items of each leaf as it reaches it and shows
+// them as they were then. A goroutine must not call into the tree, even to
+// read it, while it has an Iterator open, see Tree. A spill tree or a tree
+// opened from a file takes its write lock instead, so all writers and
+// readers block.
+type Iterator[K any, V any] struct {
+	tree   *Tree[K, V]
+	node   *bpNode[K, V]
+	keys   []K
+	values []V
+	index  int
+	closed bool
+}
+
+// Iterator returns an unpositioned iterator over the tree. Position it with
+// First, Last or Seek, and release it with Close.
+func (t *Tree[K, V]) Iterator() *Iterator[K, V] {
+	t.rlock()
+	return &Iterator[K, V]{tree: t}
+}
+
+// Close releases the tree's read lock. It is safe to call more than once.
+func (it *Iterator[K, V]) Close() {
+	if it.closed {
+		return
+	}
+	it.closed = true
+	it.move(nil)
+	it.tree.runlock()
+}
+
+// First moves to the smallest key and reports whether there is one.
+func (it *Iterator[K, V]) First() bool {
+	if it.closed {
+		return false
+	}
+	defer it.recover()
+
+	node := it.tree.root
+	for len(node.nodes) > 0 {
+		node = node.nodes[0]
+	}
+	it.move(node)
+	it.index = 0
+	return it.normalize()
+}
+
+// Last moves to the largest key and reports whether there is one.
+func (it *Iterator[K, V]) Last() bool {
+	if it.closed {
+		return false
+	}
+	defer it.recover()
+
+	node := it.tree.root
+	for len(node.nodes) > 0 {
+		node = node.nodes[len(node.nodes)-1]
+	}
+	it.move(node)
+	it.index = len(it.keys) - 1
+	return it.Valid()
+}
+
+// Seek moves to the smallest key greater than or equal to key and reports
+// whether there is one.
+func (it *Iterator[K, V]) Seek(key K) bool {
+	if it.closed {
+		return false
+	}
+	defer it.recover()
+
+	node := it.tree.findLeaf(key)
+	it.move(node)
+	it.index = searchKeys(it.tree.cmp, it.keys, key)
+	return it.normalize()
+}
+
+// Next moves to the following key and reports whether there is one.
+func (it *Iterator[K, V]) Next() bool {
+	if !it.Valid() {
+		return false
+	}
+	defer it.recover()
+	it.index++
+	return it.normalize()
+}
+
+// Prev moves to the preceding key and reports whether there is one.
+func (it *Iterator[K, V]) Prev() bool {
+	if !it.Valid() {
+		return false
+	}
+	defer it.recover()
+	it.index--
+	for it.node != nil && it.index < 0 {
+		it.move(it.node.prev)
+		if it.node != nil {
+			it.index = len(it.keys) - 1
+		}
+	}
+	return it.Valid()
+}
+
+// Valid reports whether the iterator is positioned at a key.
+func (it *Iterator[K, V]) Valid() bool {
+	return it.node != nil && it.index >= 0 && it.index < len(it.keys)
+}
+
+// Key returns the key at the current position, or the zero key if it is not
+// Valid.
+func (it *Iterator[K, V]) Key() K {
+	if !it.Valid() {
+		var zero K
+		return zero
+	}
+	return it.keys[it.index]
+}
+
+// Value returns the value at the current position, or the zero value if it
+// is not Valid.
+func (it *Iterator[K, V]) Value() V {
+	if !it.Valid() {
+		var zero V
+		return zero
+	}
+	return it.values[it.index]
+}
+
+// normalize moves a position past the end of a leaf to the start of the
+// next one.
+func (it *Iterator[K, V]) normalize() bool {
+	for it.node != nil && it.index >= len(it.keys) {
+		it.move(it.node.next)
+		it.index = 0
+	}
+	return it.Valid()
+}
+
+// recover ends the iteration when a leaf of a paged tree fails to load; the
+// tree's Err reports why. It must be deferred by the methods that move.
+func (it *Iterator[K, V]) recover() {
+	if it.tree.cache == nil {
+		return
+	}
+	r := recover()
+	if _, ok := r.(loadFailure); ok {
+		// The leaf that failed is not pinned yet, the one before still is.
+		it.tree.unpin(it.node)
+		it.node, it.keys, it.values = nil, nil, nil
+		return
+	}
+	resume(r)
+}
+
+// move positions the iterator on node and copies its items, see leafItems,
+// so no latch is held while the iterator is open. In a paged tree the leaf
+// is kept in memory until the iterator moves on.
+func (it *Iterator[K, V]) move(node *bpNode[K, V]) {
+	it.tree.pin(node)
+	it.tree.unpin(it.node)
+	it.node = node
+	if node != nil {
+		it.keys, it.values = it.tree.leafItems(node, it.keys, it.values)
+	} else {
+		it.keys, it.values = nil, nil
+	}
+}
@@ -0,0 +1,88 @@
+package bptree
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIterator(t *testing.T) {
+	tree, keys := randomTree(4, 300)
+	it := tree.Iterator()
+	defer it.Close()
+
+	got := make([]int64, 0)
+	for ok := it.First(); ok; ok = it.Next() {
+		if it.Value().(int64) != it.Key()*10 {
+			t.Fatalf("value of %d is %v", it.Key(), it.Value())
+		}
+		got = append(got, it.Key())
+	}
+	if !reflect.DeepEqual(got, keys) {
+		t.Fatalf("forward iteration = %v, want %v", got, keys)
+	}
+
+	got = got[:0]
+	for ok := it.Last(); ok; ok = it.Prev() {
+		got = append(got, it.Key())
+	}
+	for i := range keys {
+		if got[len(got)-1-i] != keys[i] {
+			t.Fatalf("backward iteration = %v, want reverse of %v", got, keys)
+		}
+	}
+}
+
+func TestIteratorSeek(t *testing.T) {
+	tree, keys := randomTree(5, 200)
+	it := tree.Iterator()
+	defer it.Close()
+
+	for i, key := range keys {
+		if !it.Seek(key) || it.Key() != key {
+			t.Fatalf("Seek(%d) landed on %d", key, it.Key())
+		}
+		// Seeking between two keys lands on the larger one.
+		if i > 0 && keys[i-1]+1 < key {
+			if !it.Seek(keys[i-1]+1) || it.Key() != key {
+				t.Fatalf("Seek(%d) landed on %d, want %d", keys[i-1]+1, it.Key(), key)
+			}
+		}
+		if i > 0 {
+			if !it.Prev() || it.Key() != keys[i-1] {
+				t.Fatalf("Prev() from %d landed on %d, want %d", key, it.Key(), keys[i-1])
+			}
+			it.Next()
+		}
+	}
+
+	if it.Seek(keys[len(keys)-1] + 1) {
+		t.Fatalf("Seek past the last key landed on %d", it.Key())
+	}
+	if it.Next() || it.Prev() {
+		t.Fatal("an exhausted iterator must stay invalid")
+	}
+}
+
+func TestIteratorClose(t *testing.T) {
+	tree := NewBPTree(4)
+	tree.Set(1, 1)
+
+	it := tree.Iterator()
+	if it.First(); it.Key() != 1 {
+		t.Fatalf("Key() = %d, want 1", it.Key())
+	}
+	it.Close()
+	it.Close()
+	if it.Valid() || it.First() {
+		t.Fatal("a closed iterator must be invalid")
+	}
+
+	// The read lock is released, so writers proceed.
+	tree.Set(2, 2)
+
+	empty := NewBPTree(4).Iterator()
+	defer empty.Close()
+	if empty.First() || empty.Last() || empty.Seek(0) {
+		t.Fatal("an empty tree has no keys")
+	}
+}
@@ -0,0 +1,125 @@
+package bptree
+
+import "sync/atomic"
+
+// Writers that change a single leaf without splitting or merging it do not
+// need the tree's write lock. They take the read lock instead, which keeps
+// every index node as it is, descend without latching, and then hold the
+// exclusive latch of the leaf while they change it. Writes to different
+// leaves thus run in parallel. The keys above the leaf stay valid because the
+// write leaves its maxKey alone, and the sizes of the index nodes on the way
+// down are adjusted atomically.
+//
+// Readers in turn hold the read latch of each leaf while they look at it.
+// Those that call back into user code or hand out an Iterator copy the items
+// of the leaf under the latch and release it first, see leafItems.
+// This is a fast path in front of the tree's lock rather than latch
+// coupling: writers never latch index nodes, so writes that do split or
+// merge, or that would change the leaf's maxKey, fall back to the write lock
+// and run one at a time. So do all writes to trees opened from a file, spill
+// trees, and trees with open snapshots or transactions, which copy, log or
+// evict nodes as they write.
+
+// latched reports whether writers may change leaves under the read lock. It
+// must be called with the read lock held.
+func (t *Tree[K, V]) latched() bool {
+	return t.store == nil && t.cache == nil && t.snapshots == 0 && len(t.txns) == 0
+}
+
+// rlatch and runlatch hold a leaf still for a reader with the read lock.
+// Trees that never change leaves under the read lock skip the latch.
+func (t *Tree[K, V]) rlatch(node *bpNode[K, V]) {
+	if node != nil && t.store == nil && t.cache == nil {
+		node.latch.RLock()
+	}
+}
+
+func (t *Tree[K, V]) runlatch(node *bpNode[K, V]) {
+	if node != nil && t.store == nil && t.cache == nil {
+		node.latch.RUnlock()
+	}
+}
+
+// leafItems returns the keys and values of a leaf. In trees where writers
+// change leaves under the read lock it copies them into keys and values,
+// reusing their space, while it holds the leaf's read latch. The caller can
+// then run callbacks without the latch held: a callback that reads the leaf
+// again would otherwise wait for it behind a waiting writer.
+func (t *Tree[K, V]) leafItems(node *bpNode[K, V], keys []K, values []V) ([]K, []V) {
+	if t.store != nil || t.cache != nil {
+		return t.leafKeys(node), node.values
+	}
+	node.latch.RLock()
+	defer node.latch.RUnlock()
+	return t.appendKeys(keys[:0], node), append(values[:0], node.values...)
+}
+
+// size returns the number of keys in the tree, including those added by
+// writers that did not take the write lock.
+func (t *Tree[K, V]) size() int {
+	return t.count + int(atomic.LoadInt64(&t.added))
+}
+
+// countLeaf is count for a child that may be a leaf being written to.
+func (t *Tree[K, V]) countLeaf(node *bpNode[K, V]) int {
+	if len(node.nodes) > 0 {
+		return node.count()
+	}
+	t.rlatch(node)
+	defer t.runlatch(node)
+	return node.count()
+}
+
+// safe reports whether a write to the item at index i of leaf, which has
+// the key written to if found, can neither split nor merge the leaf nor
+// change its maxKey. A missing key is inserted at i, which must leave the
+// leaf within width and not be at its end. A found key is replaced, or
+// removed if removes is set, which must leave the leaf at least half full
+// unless it is the root, and not be its last key.
+func (t *Tree[K, V]) safe(leaf *bpNode[K, V], i int, found, removes bool) bool {
+	switch {
+	case !found:
+		return len(leaf.keys) < t.width && i < len(leaf.keys)
+	case removes:
+		return i+1 < len(leaf.keys) && (len(leaf.keys) > t.halfw || leaf == t.root)
+	}
+	return true
+}
+
+// updateLatched tries to run change as update does, but under the read lock
+// and the latch of the leaf. It gives up and returns false without calling
+// change if the tree does not allow that or if the write might not be safe,
+// with removes set when change may remove the key.
+func (t *Tree[K, V]) updateLatched(key K, removes bool, change func(leaf *bpNode[K, V], i int, found bool) int) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if !t.latched() {
+		return false
+	}
+	var stack [16]*bpNode[K, V]
+	path := stack[:0]
+	node := t.root
+	for len(node.nodes) > 0 {
+		path = append(path, node)
+		node = node.nodes[node.findChild(t.cmp, key)]
+	}
+
+	node.latch.Lock()
+	defer node.latch.Unlock()
+	if node.packed != nil {
+		t.thaw(node)
+	}
+	i := node.search(t.cmp, key)
+	found := i < len(node.keys) && t.cmp(node.keys[i], key) == 0
+	if !t.safe(node, i, found, removes) {
+		return false
+	}
+	if delta := change(node, i, found); delta != 0 {
+		for _, p := range path {
+			atomic.AddInt64(&p.size, int64(delta))
+		}
+		atomic.AddInt64(&t.added, int64(delta))
+	}
+	return true
+}
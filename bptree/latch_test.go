@@ -0,0 +1,327 @@
+package bptree
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestLatchedStress runs writers on disjoint keys next to readers of every
+// kind. Values are key*10 plus a counter below 10, so that readers can tell
+// a value that belongs to another key. Run it with -race.
+func TestLatchedStress(t *testing.T) {
+	const writers, readers, keys = 8, 4, 4000
+	tree := NewOrderedTree[int, int](8)
+	for key := 0; key < keys; key += 4 {
+		tree.Set(key, key*10)
+	}
+
+	models := make([]map[int]int, writers)
+	var wg sync.WaitGroup
+	for g := 0; g < writers; g++ {
+		model := make(map[int]int)
+		for key := g; key < keys; key += writers {
+			if key%4 == 0 {
+				model[key] = key * 10
+			}
+		}
+		models[g] = model
+		wg.Add(1)
+		go func(g int, model map[int]int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(g)))
+			for op := 0; op < 3000; op++ {
+				key := rng.Intn(keys/writers)*writers + g
+				val := key*10 + op%10
+				switch rng.Intn(6) {
+				case 0, 1:
+					tree.Set(key, val)
+					model[key] = val
+				case 5:
+					old, ok := model[key]
+					if got, removed := tree.Remove(key); got != old || removed != ok {
+						t.Errorf("Remove(%d) = %d, %v, want %d, %v", key, got, removed, old, ok)
+						return
+					}
+					delete(model, key)
+				case 2:
+					tree.Update(key, func(old int, exists bool) (int, bool) {
+						if exists && old%10 == 9 {
+							return 0, false
+						}
+						return val, true
+					})
+					if old, ok := model[key]; ok && old%10 == 9 {
+						delete(model, key)
+					} else {
+						model[key] = val
+					}
+				case 3:
+					got, loaded := tree.GetOrSet(key, val)
+					want, ok := model[key]
+					if !ok {
+						want = val
+						model[key] = val
+					}
+					if got != want || loaded != ok {
+						t.Errorf("GetOrSet(%d) = %d, %v, want %d, %v", key, got, loaded, want, ok)
+						return
+					}
+				case 4:
+					old, ok := model[key]
+					if swapped := tree.CompareAndSwap(key, old, val); swapped != ok {
+						t.Errorf("CompareAndSwap(%d) = %v, want %v", key, swapped, ok)
+						return
+					}
+					if ok {
+						model[key] = val
+					}
+				}
+			}
+		}(g, model)
+	}
+
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(100 + r)))
+			check := func(what string, key, val int) bool {
+				if val/10 != key {
+					t.Errorf("%s: key %d has value %d", what, key, val)
+					return false
+				}
+				return true
+			}
+			for op := 0; op < 2000; op++ {
+				key := rng.Intn(keys)
+				switch rng.Intn(5) {
+				case 0:
+					if val := tree.Get(key); val != 0 && !check("Get", key, val) {
+						return
+					}
+				case 1:
+					prev := -1
+					tree.Range(key, key+100, func(k, v int) bool {
+						if k <= prev {
+							t.Errorf("Range visited %d after %d", k, prev)
+						}
+						prev = k
+						return check("Range", k, v)
+					})
+				case 2:
+					it := tree.Iterator()
+					prev := -1
+					for ok := it.Seek(key); ok && it.Key() < key+100; ok = it.Next() {
+						if it.Key() <= prev {
+							t.Errorf("Iterator at %d after %d", it.Key(), prev)
+						}
+						if !check("Iterator", it.Key(), it.Value()) {
+							break
+						}
+						prev = it.Key()
+					}
+					it.Close()
+				case 3:
+					// Keys may be added below key in between, so Select
+					// may find a smaller key.
+					if k, v, ok := tree.Select(tree.Rank(key)); ok && !check("Select", k, v) {
+						return
+					}
+				case 4:
+					if k, v, ok := tree.Floor(key); ok && (k > key || !check("Floor", k, v)) {
+						t.Errorf("Floor(%d) = %d", key, k)
+						return
+					}
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	if err := tree.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[int]int)
+	for _, model := range models {
+		for key, val := range model {
+			want[key] = val
+		}
+	}
+	if got := treeContents(tree); !reflect.DeepEqual(got, want) {
+		t.Fatalf("tree holds %d keys, want %d", len(got), len(want))
+	}
+	if tree.Len() != len(want) {
+		t.Fatalf("Len() = %d, want %d", tree.Len(), len(want))
+	}
+}
+
+// TestLatchedParallel checks that a write to one leaf does not wait for a
+// write to another: Update keeps its leaf latched while fn runs, and a Set
+// on a distant leaf still completes meanwhile.
+func TestLatchedParallel(t *testing.T) {
+	tree := NewOrderedTree[int, int](8)
+	key := 0
+	err := tree.BulkLoad(func() (int, int, bool) {
+		key += 10
+		return key, key, key <= 10000
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entered, release, updated := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	go func() {
+		tree.Update(15, func(old int, exists bool) (int, bool) {
+			close(entered)
+			<-release
+			return 15, true
+		})
+		close(updated)
+	}()
+	<-entered
+
+	set := make(chan struct{})
+	go func() {
+		tree.Set(9005, 9005)
+		close(set)
+	}()
+	select {
+	case <-set:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Set on another leaf waited for Update")
+	}
+	close(release)
+	<-updated
+
+	if tree.Get(15) != 15 || tree.Get(9005) != 9005 || tree.Len() != 1002 {
+		t.Fatalf("Get(15) = %d, Get(9005) = %d, Len() = %d", tree.Get(15), tree.Get(9005), tree.Len())
+	}
+	if err := tree.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLatchedCallback checks that no leaf latch is held while a callback
+// runs or an Iterator is open: a latched write to the same leaf from another
+// goroutine completes meanwhile.
+func TestLatchedCallback(t *testing.T) {
+	tree := NewOrderedTree[int, int](8)
+	for key := 10; key <= 1000; key += 10 {
+		tree.Set(key, key)
+	}
+	write := func(val int) {
+		done := make(chan struct{})
+		go func() {
+			tree.Set(20, val)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Set waited for the leaf of a reader")
+		}
+	}
+
+	tree.Range(10, 30, func(key, val int) bool {
+		if key == 10 {
+			write(21)
+		}
+		if key == 20 && val != 20 {
+			t.Fatalf("Range saw %d for 20, want the value it started with", val)
+		}
+		return true
+	})
+	if got := tree.Get(20); got != 21 {
+		t.Fatalf("Get(20) = %d after Range, want 21", got)
+	}
+
+	it := tree.Iterator()
+	if !it.Seek(20) {
+		t.Fatal("Seek(20) found nothing")
+	}
+	write(22)
+	if it.Value() != 21 {
+		t.Fatalf("Value() = %d, want the value at Seek", it.Value())
+	}
+	it.Close()
+	if got := tree.GetAll(20); !reflect.DeepEqual(got, []int{22}) {
+		t.Fatalf("GetAll(20) = %v", got)
+	}
+}
+
+// TestLatchedFallback checks that writes take the write lock in the trees
+// that do not allow latched writes.
+func TestLatchedFallback(t *testing.T) {
+	tree, _ := randomTree(8, 1000)
+	snap := tree.Snapshot()
+	if tree.updateLatched(5, false, nil) {
+		t.Fatal("latched write with an open snapshot")
+	}
+	snap.Close()
+	tx := tree.Begin()
+	if tree.updateLatched(5, false, nil) {
+		t.Fatal("latched write with an open transaction")
+	}
+	tx.Rollback()
+
+	// Removing the last key of a leaf would change its maxKey.
+	if tree.updateLatched(tree.root.maxKey, true, nil) {
+		t.Fatal("latched removal of the last key")
+	}
+
+	// A missing key above the maxKey of its leaf would change the maxKey.
+	if tree.updateLatched(1<<40, false, nil) {
+		t.Fatal("latched write past the last key")
+	}
+}
+
+var benchGoroutines = []int{1, 2, 4, 8, 16, 32}
+
+// benchConcurrent runs b.N calls of op spread over each number of
+// goroutines, on a tree holding every other key below 1<<20.
+func benchConcurrent(b *testing.B, op func(tree *Tree[int, int], rng *rand.Rand)) {
+	for _, n := range benchGoroutines {
+		tree := NewOrderedTree[int, int](64)
+		i := -2
+		tree.BulkLoad(func() (int, int, bool) {
+			i += 2
+			return i, i, i < 1<<20
+		}, 0.75)
+		b.Run(fmt.Sprintf("goroutines=%d", n), func(b *testing.B) {
+			var wg sync.WaitGroup
+			for g := 0; g < n; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					rng := rand.New(rand.NewSource(int64(g)))
+					for i := g; i < b.N; i += n {
+						op(tree, rng)
+					}
+				}(g)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func BenchmarkConcurrentSet(b *testing.B) {
+	benchConcurrent(b, func(tree *Tree[int, int], rng *rand.Rand) {
+		key := rng.Intn(1 << 20)
+		tree.Set(key, key)
+	})
+}
+
+func BenchmarkConcurrentMixed(b *testing.B) {
+	benchConcurrent(b, func(tree *Tree[int, int], rng *rand.Rand) {
+		key := rng.Intn(1 << 20)
+		if rng.Intn(10) == 0 {
+			tree.Set(key, key)
+		} else {
+			tree.Get(key)
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package bptree
+
+import "reflect"
+
+// NewMultiTree returns an empty multimap tree, which can hold several values
+// per key. Add adds a value after those the key already has, and GetAll and
+// iteration return the values of a key in the order they were added.
+//
+// Get, Set and Remove work on the first value of a key: Get returns it, Set
+// replaces it and Remove removes it. Multimap trees are kept in memory only.
+func NewMultiTree[K any, V any](width int, compare func(a, b K) int) *Tree[K, V] {
+	tree := NewTree[K, V](width, compare)
+	tree.multi = true
+	return tree
+}
+
+// Add adds value to key after the values it already has. In a tree that is
+// not a multimap it is the same as Set.
+func (t *Tree[K, V]) Add(key K, value V) {
+	if !t.multi {
+		t.Set(key, value)
+		return
+	}
+
+	t.lock()
+	defer t.unlock()
+
+	t.root = t.mutable(t.root)
+	t.setValue(nil, t.root, key, value, true)
+	t.count++
+	t.track(key)
+}
+
+// GetAll returns the values of key in the order they were added.
+func (t *Tree[K, V]) GetAll(key K) []V {
+	t.rlock()
+	defer t.runlock()
+
+	var values []V
+	node := t.pin(t.findLeaf(key))
+	keys, vals := t.leafItems(node, nil, nil)
+	i := searchKeys(t.cmp, keys, key)
+	for node != nil {
+		for ; i < len(keys); i++ {
+			if t.cmp(keys[i], key) != 0 {
+				t.unpin(node)
+				return values
+			}
+			values = append(values, vals[i])
+		}
+		t.unpin(node)
+		if node = t.pin(node.next); node != nil {
+			keys, vals = t.leafItems(node, keys, vals)
+		}
+		i = 0
+	}
+	return values
+}
+
+// RemoveValue removes the first value of key equal to value, as compared by
+// reflect.DeepEqual, and reports whether there was one.
+func (t *Tree[K, V]) RemoveValue(key K, value V) bool {
+	t.lock()
+	defer t.unlock()
+
+	removed := t.remove(key, func(v V) bool {
+		return reflect.DeepEqual(v, value)
+	})
+	if removed {
+		// A tree with a file holds one value per key, so logging the
+		// removal of the key replays this removal.
+		t.logRemove(key)
+		t.track(key)
+		t.maybeCheckpoint()
+	}
+	return removed
+}
@@ -0,0 +1,178 @@
+package bptree
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMultiTreeRun(t *testing.T) {
+	// A hundred values of one key span many leaves of width 4.
+	tree := NewMultiTree[int64, int](4, Compare[int64])
+	tree.Add(0, -1)
+	tree.Add(2, -2)
+	for i := 0; i < 100; i++ {
+		tree.Add(1, i)
+	}
+	if err := tree.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+
+	values := tree.GetAll(1)
+	if len(values) != 100 {
+		t.Fatalf("GetAll(1) returned %d values, want 100", len(values))
+	}
+	for i, val := range values {
+		if val != i {
+			t.Fatalf("GetAll(1)[%d] = %d, want insertion order", i, val)
+		}
+	}
+	if tree.Get(1) != 0 {
+		t.Fatalf("Get(1) = %d, want the first value", tree.Get(1))
+	}
+	if _, val, _ := tree.Floor(1); val != 99 {
+		t.Fatalf("Floor(1) = %d, want the last value", val)
+	}
+	if _, val, _ := tree.Successor(1); val != -2 {
+		t.Fatalf("Successor(1) = %d, want -2", val)
+	}
+	if _, val, _ := tree.Predecessor(1); val != -1 {
+		t.Fatalf("Predecessor(1) = %d, want -1", val)
+	}
+	if n := tree.CountRange(1, 1); n != 100 {
+		t.Fatalf("CountRange(1, 1) = %d, want 100", n)
+	}
+	if r := tree.Rank(2); r != 101 {
+		t.Fatalf("Rank(2) = %d, want 101", r)
+	}
+
+	var desc []int
+	tree.Descend(1, func(key int64, val int) bool {
+		desc = append(desc, val)
+		return true
+	})
+	if len(desc) != 101 || desc[0] != 99 || desc[99] != 0 || desc[100] != -1 {
+		t.Fatalf("Descend(1) visited %d values from %d", len(desc), desc[0])
+	}
+
+	// Removing values from the middle of the run keeps the others in order.
+	for i := 10; i < 90; i++ {
+		if !tree.RemoveValue(1, i) {
+			t.Fatalf("RemoveValue(1, %d) found nothing", i)
+		}
+	}
+	if tree.RemoveValue(1, 50) {
+		t.Fatal("RemoveValue removed a value twice")
+	}
+	if err := tree.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	values = tree.GetAll(1)
+	if len(values) != 20 || values[9] != 9 || values[10] != 90 {
+		t.Fatalf("GetAll(1) = %v", values)
+	}
+}
+
+type multiEntry struct {
+	key int64
+	val int
+}
+
+func TestMultiTreeModel(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	for _, width := range []int{3, 4, 7} {
+		tree := NewMultiTree[int64, int](width, Compare[int64])
+		var model []multiEntry
+
+		for op := 0; op < 3000; op++ {
+			key := rng.Int63n(8)
+			switch rng.Intn(5) {
+			case 0, 1, 2:
+				tree.Add(key, op)
+				i := sort.Search(len(model), func(i int) bool { return model[i].key > key })
+				model = append(model[:i], append([]multiEntry{{key, op}}, model[i:]...)...)
+			case 3:
+				var vals []int
+				for _, e := range model {
+					if e.key == key {
+						vals = append(vals, e.val)
+					}
+				}
+				if len(vals) == 0 {
+					continue
+				}
+				val := vals[rng.Intn(len(vals))]
+				if !tree.RemoveValue(key, val) {
+					t.Fatalf("width %d op %d: RemoveValue(%d, %d) found nothing", width, op, key, val)
+				}
+				for i, e := range model {
+					if e.key == key && e.val == val {
+						model = append(model[:i], model[i+1:]...)
+						break
+					}
+				}
+			case 4:
+				tree.Remove(key)
+				for i, e := range model {
+					if e.key == key {
+						model = append(model[:i], model[i+1:]...)
+						break
+					}
+				}
+			}
+
+			if err := tree.CheckInvariants(); err != nil {
+				t.Fatalf("width %d op %d: %v", width, op, err)
+			}
+		}
+
+		var got []multiEntry
+		tree.Ascend(-1, func(key int64, val int) bool {
+			got = append(got, multiEntry{key, val})
+			return true
+		})
+		if !reflect.DeepEqual(got, model) {
+			t.Fatalf("width %d: tree and model differ", width)
+		}
+		for key := int64(0); key < 8; key++ {
+			var want []int
+			for _, e := range model {
+				if e.key == key {
+					want = append(want, e.val)
+				}
+			}
+			if got := tree.GetAll(key); !reflect.DeepEqual(got, want) {
+				t.Fatalf("width %d: GetAll(%d) = %v, want %v", width, key, got, want)
+			}
+		}
+	}
+}
+
+func TestMultiTreeBulkLoad(t *testing.T) {
+	tree := NewMultiTree[int64, int](4, Compare[int64])
+	i := 0
+	err := tree.BulkLoad(func() (int64, int, bool) {
+		i++
+		return int64(i / 10), i, i <= 100
+	}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	if got := tree.GetAll(5); !reflect.DeepEqual(got, []int{50, 51, 52, 53, 54, 55, 56, 57, 58, 59}) {
+		t.Fatalf("GetAll(5) = %v", got)
+	}
+
+	// Unique trees still reject duplicates.
+	i = 0
+	err = NewBPTree(4).BulkLoad(func() (int64, interface{}, bool) {
+		i++
+		return int64(i / 10), i, i <= 100
+	}, 1)
+	if err != ErrUnsorted {
+		t.Fatalf("err = %v, want %v", err, ErrUnsorted)
+	}
+}
@@ -1,129 +1,314 @@
 package bptree
 
-type bpItem struct {
-	key   int64
-	value interface{}
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// bpNode is a leaf or an index node. Both kinds keep their keys in a single
+// array, so that searching a node scans contiguous memory: a leaf holds its
+// own keys with the values in a parallel array, and an index node holds the
+// maxKey of each of its children next to the array of children.
+//
+// The fields both kinds need are in bpNode itself. Those only leaves need
+// are in a leafState, which index nodes leave nil and which leaves allocate
+// in the same block as the node, see newLeafNode. Its fields are promoted,
+// so they read like those of the node, but must only be used on leaves.
+//
+// The two kinds are not separate types behind an interface, because the
+// children of an index node would then be interface values, twice the size
+// of a pointer. The only index field a leaf carries is the empty nodes
+// slice header.
+type bpNode[K any, V any] struct {
+	// The number of keys below an index node, see count. Writers that hold
+	// only the tree's read lock change it atomically, see updateLatched, so
+	// it comes first to be 64-bit aligned on 32-bit platforms.
+	size int64
+
+	maxKey K
+	keys   []K
+	nodes  []*bpNode[K, V]
+
+	*leafState[K, V]
+
+	// The tree epoch the node was created in, see Tree.mutable.
+	version uint64
+
+	// Where the node is stored if the tree was opened from a file, or where
+	// a leaf of a spill tree was spilled to: its first page, continuation
+	// pages, and whether it changed since it was written, or for a file,
+	// since the last checkpoint.
+	page  pageID
+	more  []pageID
+	dirty bool
+
+	// Whether the items of a leaf of a paged tree were dropped from memory,
+	// with size holding their number. It belongs to the leafState, but
+	// takes no space here next to dirty.
+	spilled bool
 }
 
-type stringKV struct {
-	key   string
-	value interface{}
+// leafState is the part of a leaf that index nodes do without.
+type leafState[K any, V any] struct {
+	values []V
+	next   *bpNode[K, V]
+	prev   *bpNode[K, V]
+
+	// The keys of a frozen leaf, packed by the tree's keyPacker while keys
+	// is nil. See Freeze.
+	packed []byte
+
+	// Guards the keys and values of a leaf while writers hold only the
+	// tree's read lock, see updateLatched.
+	latch sync.RWMutex
+
+	// For leaves of a paged tree: the leaf's place in the page cache while
+	// its items are in memory, and the pins that keep them there.
+	lru  *list.Element
+	pins int
 }
 
-type bpNode struct {
-	maxKey int64
-	nodes  []*bpNode
-	items  []bpItem
-	next   *bpNode
+// leafNode is a leaf as it is allocated: the node and its leafState.
+type leafNode[K any, V any] struct {
+	node  bpNode[K, V]
+	state leafState[K, V]
 }
 
-func newLeafNode(width int) *bpNode {
-	node := &bpNode{}
-	node.items = make([]bpItem, width+1)
-	node.items = node.items[0:0]
-	return node
+// allocLeaf returns a leaf with no items and no arrays.
+func allocLeaf[K any, V any]() *bpNode[K, V] {
+	leaf := new(leafNode[K, V])
+	leaf.node.leafState = &leaf.state
+	return &leaf.node
 }
 
-func newIndexNode(width int) *bpNode {
-	node := &bpNode{}
-	node.nodes = make([]*bpNode, width+1)
-	node.nodes = node.nodes[0:0]
+func newLeafNode[K any, V any](width int) *bpNode[K, V] {
+	node := allocLeaf[K, V]()
+	node.keys = make([]K, 0, width+1)
+	node.values = make([]V, 0, width+1)
 	return node
 }
 
-func (node *bpNode) findItem(key int64) int {
-	num := len(node.items)
-	for i := 0; i < num; i++ {
-		if node.items[i].key > key {
-			return -1
-		} else if node.items[i].key == key {
-			return i
+func newIndexNode[K any, V any](width int) *bpNode[K, V] {
+	return &bpNode[K, V]{
+		keys:  make([]K, 0, width+1),
+		nodes: make([]*bpNode[K, V], 0, width+1),
+	}
+}
+
+// searchKeys returns the index of the first key not less than key, or the
+// number of keys if there is none. Like sort.Search it is a binary search,
+// written out to avoid calling a closure per step.
+func searchKeys[K any](cmp func(a, b K) int, keys []K, key K) int {
+	lo, hi := 0, len(keys)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if cmp(keys[mid], key) < 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// searchKeysAfter returns the index of the first key greater than key, or
+// the number of keys if there is none.
+func searchKeysAfter[K any](cmp func(a, b K) int, keys []K, key K) int {
+	lo, hi := 0, len(keys)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if cmp(keys[mid], key) <= 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
 		}
 	}
+	return lo
+}
+
+// search and searchAfter are searchKeys and searchKeysAfter on the keys of
+// an index node or of a leaf that is not frozen.
+func (node *bpNode[K, V]) search(cmp func(a, b K) int, key K) int {
+	return searchKeys(cmp, node.keys, key)
+}
+
+func (node *bpNode[K, V]) searchAfter(cmp func(a, b K) int, key K) int {
+	return searchKeysAfter(cmp, node.keys, key)
+}
+
+// count returns the number of keys in the subtree of node.
+func (node *bpNode[K, V]) count() int {
+	if node.leafState == nil || node.spilled {
+		return int(atomic.LoadInt64(&node.size))
+	}
+	return len(node.values)
+}
+
+// recount sets the size of an index node from its children.
+func (node *bpNode[K, V]) recount() {
+	node.size = 0
+	for _, child := range node.nodes {
+		node.size += int64(child.count())
+	}
+}
+
+// rekey sets the keys and maxKey of an index node from its children, after
+// they were moved around.
+func (node *bpNode[K, V]) rekey() {
+	node.keys = node.keys[:0]
+	for _, child := range node.nodes {
+		node.keys = append(node.keys, child.maxKey)
+	}
+	if len(node.keys) > 0 {
+		node.maxKey = node.keys[len(node.keys)-1]
+	}
+}
+
+// fixKey updates the key of child i of an index node after the child
+// changed, and the node's own maxKey.
+func (node *bpNode[K, V]) fixKey(i int) {
+	if i < len(node.nodes) {
+		node.keys[i] = node.nodes[i].maxKey
+	}
+	if len(node.keys) > 0 {
+		node.maxKey = node.keys[len(node.keys)-1]
+	}
+}
+
+func (node *bpNode[K, V]) findItem(cmp func(a, b K) int, key K) int {
+	i := node.search(cmp, key)
+	if i < len(node.keys) && cmp(node.keys[i], key) == 0 {
+		return i
+	}
 	return -1
 }
 
-func (node *bpNode) setValue(key int64, value interface{}) {
-	item := bpItem{
-		key:   key,
-		value: value,
+// findChild returns the index of the first child whose maxKey is not less
+// than key, or the last child if key is above all of them.
+func (node *bpNode[K, V]) findChild(cmp func(a, b K) int, key K) int {
+	if i := node.search(cmp, key); i < len(node.nodes) {
+		return i
 	}
+	return len(node.nodes) - 1
+}
 
-	num := len(node.items)
-	if num < 1 {
-		node.items = append(node.items, item)
-		node.maxKey = item.key
-		return
-	} else if key < node.items[0].key {
-		node.items = append([]bpItem{item}, node.items...)
-		return
-	} else if key > node.items[num-1].key {
-		node.items = append(node.items, item)
-		node.maxKey = item.key
-		return
+// findLastChild returns the index of the first child whose maxKey is
+// greater than key, or the last child if there is none. Unlike findChild it
+// leads to the last leaf that can hold a key with duplicates.
+func (node *bpNode[K, V]) findLastChild(cmp func(a, b K) int, key K) int {
+	if i := node.searchAfter(cmp, key); i < len(node.nodes) {
+		return i
 	}
+	return len(node.nodes) - 1
+}
 
-	for i := 0; i < num; i++ {
-		if node.items[i].key > key {
-			node.items = append(node.items, bpItem{})
-			copy(node.items[i+1:], node.items[i:])
-			node.items[i] = item
-			return
-		} else if node.items[i].key == key {
-			node.items[i] = item
-			return
-		}
+// setValue reports whether key was newly added rather than replaced.
+func (node *bpNode[K, V]) setValue(cmp func(a, b K) int, key K, value V) bool {
+	node.dirty = true
+
+	i := node.search(cmp, key)
+	if i < len(node.keys) && cmp(node.keys[i], key) == 0 {
+		node.keys[i], node.values[i] = key, value
+		return false
 	}
+	node.insertItem(i, key, value)
+	return true
 }
 
-func (node *bpNode) addChild(child *bpNode) {
-	num := len(node.nodes)
-	if num < 1 {
-		node.nodes = append(node.nodes, child)
-		node.maxKey = child.maxKey
-		return
-	} else if child.maxKey < node.nodes[0].maxKey {
-		node.nodes = append([]*bpNode{child}, node.nodes...)
-		return
-	} else if child.maxKey > node.nodes[num-1].maxKey {
-		node.nodes = append(node.nodes, child)
-		node.maxKey = child.maxKey
-		return
+// addValue inserts key after the items with an equal key.
+func (node *bpNode[K, V]) addValue(cmp func(a, b K) int, key K, value V) {
+	node.insertItem(node.searchAfter(cmp, key), key, value)
+}
+
+// insertItem inserts key at index i of a leaf.
+func (node *bpNode[K, V]) insertItem(i int, key K, value V) {
+	var zero V
+	node.dirty = true
+	node.keys = append(node.keys, key)
+	copy(node.keys[i+1:], node.keys[i:])
+	node.keys[i] = key
+	node.values = append(node.values, zero)
+	copy(node.values[i+1:], node.values[i:])
+	node.values[i] = value
+	if i == len(node.keys)-1 {
+		node.maxKey = key
 	}
+}
 
-	for i := 0; i < num; i++ {
-		if node.nodes[i].maxKey > child.maxKey {
-			node.nodes = append(node.nodes, nil)
-			copy(node.nodes[i+1:], node.nodes[i:])
-			node.nodes[i] = child
-			return
-		}
+// removeItem removes the item at index i of a leaf.
+func (node *bpNode[K, V]) removeItem(i int) {
+	node.removeItems(i, i+1)
+}
+
+// removeItems removes the items from index i up to j of a leaf. The values
+// left behind at the end of the array are cleared so that they can be
+// collected.
+func (node *bpNode[K, V]) removeItems(i, j int) {
+	var zero V
+	n := len(node.keys)
+	node.dirty = true
+	node.keys = append(node.keys[:i], node.keys[j:]...)
+	copy(node.values[i:], node.values[j:])
+	for k := n - (j - i); k < n; k++ {
+		node.values[k] = zero
+	}
+	node.values = node.values[:len(node.keys)]
+	if len(node.keys) > 0 {
+		node.maxKey = node.keys[len(node.keys)-1]
 	}
 }
 
-func (node *bpNode) deleteItem(key int64) bool {
-	num := len(node.items)
+// addChild inserts child right after the child prev, or first if prev is
+// nil. Children are placed by position rather than by maxKey, which is
+// ambiguous when runs of duplicate keys span several nodes. The key of prev
+// is updated too, since adding child usually means prev was split.
+func (node *bpNode[K, V]) addChild(prev, child *bpNode[K, V]) {
+	node.dirty = true
+	i := 0
+	for prev != nil && i < len(node.nodes) {
+		i++
+		if node.nodes[i-1] == prev {
+			node.keys[i-1] = prev.maxKey
+			break
+		}
+	}
+	node.nodes = append(node.nodes, nil)
+	copy(node.nodes[i+1:], node.nodes[i:])
+	node.nodes[i] = child
+	node.keys = append(node.keys, child.maxKey)
+	copy(node.keys[i+1:], node.keys[i:])
+	node.keys[i] = child.maxKey
+	node.maxKey = node.keys[len(node.keys)-1]
+}
 
-	for i := 0; i < num; i++ {
-		if node.items[i].key > key {
-			return false
-		} else if node.items[i].key == key {
-			copy(node.items[i:], node.items[i+1:])
-			node.items = node.items[0 : len(node.items)-1]
-			node.maxKey = node.items[len(node.items)-1].key
-			return true
+// deleteItem removes the first item with key whose value satisfies match,
+// or the first item with key if match is nil.
+func (node *bpNode[K, V]) deleteItem(cmp func(a, b K) int, key K, match func(V) bool) bool {
+	i := node.search(cmp, key)
+	for ; i < len(node.keys) && cmp(node.keys[i], key) == 0; i++ {
+		if match == nil || match(node.values[i]) {
+			break
 		}
 	}
-	return false
+	if i == len(node.keys) || cmp(node.keys[i], key) != 0 {
+		return false
+	}
+	node.removeItem(i)
+	return true
 }
 
-func (node *bpNode) deleteChild(child *bpNode) bool {
+func (node *bpNode[K, V]) deleteChild(child *bpNode[K, V]) bool {
 	num := len(node.nodes)
 	for i := 0; i < num; i++ {
 		if node.nodes[i] == child {
+			node.dirty = true
 			copy(node.nodes[i:], node.nodes[i+1:])
-			node.nodes = node.nodes[0 : len(node.nodes)-1]
-			node.maxKey = node.nodes[len(node.nodes)-1].maxKey
+			node.nodes[num-1] = nil
+			node.nodes = node.nodes[0 : num-1]
+			copy(node.keys[i:], node.keys[i+1:])
+			node.keys = node.keys[0 : num-1]
+			node.maxKey = node.keys[len(node.keys)-1]
 			return true
 		}
 	}
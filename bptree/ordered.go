@@ -0,0 +1,200 @@
+package bptree
+
+// Len returns the number of keys in the tree.
+func (t *Tree[K, V]) Len() int {
+	t.rlock()
+	defer t.runlock()
+
+	return t.size()
+}
+
+// Min returns the smallest key and its value. ok is false if the tree is empty.
+func (t *Tree[K, V]) Min() (key K, val V, ok bool) {
+	t.rlock()
+	defer t.runlock()
+
+	node := t.root
+	for len(node.nodes) > 0 {
+		node = node.nodes[0]
+	}
+	t.load(node)
+	t.rlatch(node)
+	defer t.runlatch(node)
+	return t.itemAt(node, 0)
+}
+
+// Max returns the largest key and its value. ok is false if the tree is empty.
+func (t *Tree[K, V]) Max() (key K, val V, ok bool) {
+	t.rlock()
+	defer t.runlock()
+
+	node := t.root
+	for len(node.nodes) > 0 {
+		node = node.nodes[len(node.nodes)-1]
+	}
+	t.load(node)
+	t.rlatch(node)
+	defer t.runlatch(node)
+	return t.itemAt(node, len(node.values)-1)
+}
+
+// Floor returns the largest key less than or equal to key.
+func (t *Tree[K, V]) Floor(key K) (K, V, bool) {
+	t.rlock()
+	defer t.runlock()
+
+	return t.below(key, true)
+}
+
+// Ceiling returns the smallest key greater than or equal to key.
+func (t *Tree[K, V]) Ceiling(key K) (K, V, bool) {
+	t.rlock()
+	defer t.runlock()
+
+	return t.above(key, true)
+}
+
+// Predecessor returns the largest key strictly less than key.
+func (t *Tree[K, V]) Predecessor(key K) (K, V, bool) {
+	t.rlock()
+	defer t.runlock()
+
+	return t.below(key, false)
+}
+
+// Successor returns the smallest key strictly greater than key.
+func (t *Tree[K, V]) Successor(key K) (K, V, bool) {
+	t.rlock()
+	defer t.runlock()
+
+	return t.above(key, false)
+}
+
+// below finds the last key before key, or at key if inclusive. The answer
+// is in the leaf key routes to, or is the last key of the leaf before it.
+func (t *Tree[K, V]) below(key K, inclusive bool) (K, V, bool) {
+	var node *bpNode[K, V]
+	var i int
+	if inclusive {
+		node = t.findLastLeaf(key)
+		t.rlatch(node)
+		i = searchKeysAfter(t.cmp, t.leafKeys(node), key) - 1
+	} else {
+		node = t.findLeaf(key)
+		t.rlatch(node)
+		i = searchKeys(t.cmp, t.leafKeys(node), key) - 1
+	}
+	if i < 0 && node.prev != nil {
+		t.runlatch(node)
+		node = t.load(node.prev)
+		t.rlatch(node)
+		i = len(node.values) - 1
+	}
+	defer t.runlatch(node)
+	return t.itemAt(node, i)
+}
+
+// above finds the first key after key, or at key if inclusive. The answer
+// is in the leaf key routes to, or is the first key of the leaf after it.
+func (t *Tree[K, V]) above(key K, inclusive bool) (K, V, bool) {
+	var node *bpNode[K, V]
+	var i int
+	if inclusive {
+		node = t.findLeaf(key)
+		t.rlatch(node)
+		i = searchKeys(t.cmp, t.leafKeys(node), key)
+	} else {
+		node = t.findLastLeaf(key)
+		t.rlatch(node)
+		i = searchKeysAfter(t.cmp, t.leafKeys(node), key)
+	}
+	if i == len(node.values) && node.next != nil {
+		t.runlatch(node)
+		node = t.load(node.next)
+		t.rlatch(node)
+		i = 0
+	}
+	defer t.runlatch(node)
+	return t.itemAt(node, i)
+}
+
+func (t *Tree[K, V]) itemAt(node *bpNode[K, V], i int) (key K, val V, ok bool) {
+	if i < 0 || i >= len(node.values) {
+		return key, val, false
+	}
+	return t.leafKeys(node)[i], node.values[i], true
+}
+
+// Rank returns the number of keys less than key, which is the position key
+// has or would have in ascending order.
+func (t *Tree[K, V]) Rank(key K) int {
+	t.rlock()
+	defer t.runlock()
+
+	return t.rank(key, false)
+}
+
+// Select returns the key at position i in ascending order, counting from
+// zero, and reports whether there is one.
+func (t *Tree[K, V]) Select(i int) (key K, val V, ok bool) {
+	t.rlock()
+	defer t.runlock()
+
+	if i < 0 || i >= t.size() {
+		return key, val, false
+	}
+	// Writers may remove keys from leaves meanwhile, see updateLatched, so
+	// i can run past the last child, and then past the end of its leaf.
+	node := t.root
+	for len(node.nodes) > 0 {
+		for j, child := range node.nodes {
+			n := t.countLeaf(child)
+			if i < n || j == len(node.nodes)-1 {
+				node = child
+				break
+			}
+			i -= n
+		}
+	}
+	t.load(node)
+	t.rlatch(node)
+	defer t.runlatch(node)
+	return t.itemAt(node, i)
+}
+
+// CountRange returns the number of keys in [lo, hi].
+func (t *Tree[K, V]) CountRange(lo, hi K) int {
+	t.rlock()
+	defer t.runlock()
+
+	if t.cmp(lo, hi) > 0 {
+		return 0
+	}
+	return t.rank(hi, true) - t.rank(lo, false)
+}
+
+// rank counts the keys less than key, or not greater than key if inclusive.
+// The children before the one key routes to hold only smaller keys, so a
+// descent adds up their counts and ends with a search in the leaf.
+func (t *Tree[K, V]) rank(key K, inclusive bool) int {
+	rank := 0
+	node := t.root
+	for len(node.nodes) > 0 {
+		i := node.findChild(t.cmp, key)
+		if inclusive {
+			i = node.findLastChild(t.cmp, key)
+		}
+		for _, child := range node.nodes[:i] {
+			rank += t.countLeaf(child)
+		}
+		node = node.nodes[i]
+	}
+	t.load(node)
+	t.rlatch(node)
+	defer t.runlatch(node)
+	keys := t.leafKeys(node)
+	if inclusive {
+		return rank + searchKeysAfter(t.cmp, keys, key)
+	}
+	return rank + searchKeys(t.cmp, keys, key)
+}
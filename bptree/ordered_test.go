@@ -0,0 +1,149 @@
+package bptree
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestLen(t *testing.T) {
+	tree := NewBPTree(4)
+	for i := 0; i < 100; i++ {
+		tree.Set(int64(i%60), i)
+	}
+	if tree.Len() != 60 {
+		t.Fatalf("Len() = %d after overwrites, want 60", tree.Len())
+	}
+
+	// A single leaf, so Remove never has to rebalance.
+	small := NewBPTree(16)
+	for i := int64(0); i < 10; i++ {
+		small.Set(i, i)
+	}
+	small.Remove(3)
+	small.Remove(3)
+	small.Remove(42)
+	if small.Len() != 9 {
+		t.Fatalf("Len() = %d after removes, want 9", small.Len())
+	}
+	for i := int64(0); i < 10; i++ {
+		small.Remove(i)
+	}
+	if small.Len() != 0 {
+		t.Fatalf("Len() = %d after removing everything, want 0", small.Len())
+	}
+	if _, _, ok := small.Min(); ok {
+		t.Fatal("an emptied tree has no minimum")
+	}
+}
+
+func TestMinMax(t *testing.T) {
+	tree := NewBPTree(4)
+	if _, _, ok := tree.Min(); ok {
+		t.Fatal("an empty tree has no minimum")
+	}
+	if _, _, ok := tree.Max(); ok {
+		t.Fatal("an empty tree has no maximum")
+	}
+
+	tree, keys := randomTree(4, 200)
+	if key, val, ok := tree.Min(); !ok || key != keys[0] || val.(int64) != keys[0]*10 {
+		t.Fatalf("Min() = %d, %v, %v, want %d", key, val, ok, keys[0])
+	}
+	if key, _, ok := tree.Max(); !ok || key != keys[len(keys)-1] {
+		t.Fatalf("Max() = %d, %v, want %d", key, ok, keys[len(keys)-1])
+	}
+}
+
+func TestFloorCeiling(t *testing.T) {
+	tree, keys := randomTree(5, 300)
+
+	// lowerBound returns the index of the first key >= key.
+	lowerBound := func(key int64) int {
+		return sort.Search(len(keys), func(i int) bool { return keys[i] >= key })
+	}
+	check := func(name string, key int64, i int, got int64, ok bool) {
+		if wantOK := i >= 0 && i < len(keys); ok != wantOK || ok && got != keys[i] {
+			t.Fatalf("%s(%d) = %d, %v", name, key, got, ok)
+		}
+	}
+
+	for n := 0; n < 1000; n++ {
+		key := rand.Int63n(1300) - 50
+		i := lowerBound(key)
+		exact := i < len(keys) && keys[i] == key
+
+		got, _, ok := tree.Ceiling(key)
+		check("Ceiling", key, i, got, ok)
+
+		got, _, ok = tree.Successor(key)
+		if exact {
+			check("Successor", key, i+1, got, ok)
+		} else {
+			check("Successor", key, i, got, ok)
+		}
+
+		got, _, ok = tree.Predecessor(key)
+		check("Predecessor", key, i-1, got, ok)
+
+		got, _, ok = tree.Floor(key)
+		if exact {
+			check("Floor", key, i, got, ok)
+		} else {
+			check("Floor", key, i-1, got, ok)
+		}
+	}
+}
+
+func TestRankSelect(t *testing.T) {
+	for _, width := range []int{3, 4, 16} {
+		tree := NewBPTree(width)
+		present := make(map[int64]bool)
+		for i := 0; i < 3000; i++ {
+			key := rand.Int63n(1000) * 2
+			if rand.Intn(3) == 0 {
+				tree.Remove(key)
+				delete(present, key)
+			} else {
+				tree.Set(key, key)
+				present[key] = true
+			}
+		}
+		keys := make([]int64, 0, len(present))
+		for key := range present {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+		for key := int64(-1); key <= 2001; key++ {
+			want := sort.Search(len(keys), func(i int) bool { return keys[i] >= key })
+			if got := tree.Rank(key); got != want {
+				t.Fatalf("width %d: Rank(%d) = %d, want %d", width, key, got, want)
+			}
+		}
+		for i, want := range keys {
+			if key, val, ok := tree.Select(i); !ok || key != want || val != want {
+				t.Fatalf("width %d: Select(%d) = %d, %v, %v, want %d", width, i, key, val, ok, want)
+			}
+		}
+		if _, _, ok := tree.Select(len(keys)); ok {
+			t.Fatalf("width %d: Select(Len()) found a key", width)
+		}
+		if _, _, ok := tree.Select(-1); ok {
+			t.Fatalf("width %d: Select(-1) found a key", width)
+		}
+
+		for i := 0; i < 200; i++ {
+			lo, hi := rand.Int63n(2100)-50, rand.Int63n(2100)-50
+			want := 0
+			for _, key := range keys {
+				if key >= lo && key <= hi {
+					want++
+				}
+			}
+			if got := tree.CountRange(lo, hi); got != want {
+				t.Fatalf("width %d: CountRange(%d, %d) = %d, want %d", width, lo, hi, got, want)
+			}
+		}
+	}
+}
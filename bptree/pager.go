@@ -0,0 +1,217 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// pager splits a file into fixed-size pages. Page 0 holds the two file
+// header slots; every other page belongs to a node, to the stored free
+// list, or is free.
+//
+// Pages are never overwritten while the last committed header can reach
+// them: new versions of nodes always go to free pages, and pages released
+// since the last commit only become reusable after the next one. A crash in
+// the middle of a checkpoint therefore leaves the previous tree intact.
+//
+// A node is stored as a chain of pages, each starting with a page header:
+//
+//	type u8 | next page u64 | payload length u32
+type pager struct {
+	file      File
+	pageSize  int
+	pageCount uint64
+
+	// Pages that may be written now, and pages released since the last
+	// commit.
+	free    []pageID
+	pending []pageID
+}
+
+type pageID = uint64
+
+const (
+	pageTypeLeaf  byte = 1
+	pageTypeIndex byte = 2
+	pageTypeMore  byte = 3
+	pageTypeFree  byte = 4
+
+	pageHeaderSize = 1 + 8 + 4
+
+	defaultPageSize = 4096
+	minPageSize     = 256
+)
+
+var (
+	// ErrCorrupted is returned when a file does not contain a valid tree.
+	ErrCorrupted = errors.New("bptree: file is corrupted")
+
+	// ErrClosed is returned by operations on a closed disk tree.
+	ErrClosed = errors.New("bptree: tree is closed")
+)
+
+func (p *pager) readPage(id pageID) ([]byte, error) {
+	if id == 0 || id >= p.pageCount {
+		return nil, ErrCorrupted
+	}
+	buf := make([]byte, p.pageSize)
+	if _, err := p.file.ReadAt(buf, int64(id)*int64(p.pageSize)); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (p *pager) writePage(id pageID, buf []byte) error {
+	_, err := p.file.WriteAt(buf, int64(id)*int64(p.pageSize))
+	return err
+}
+
+// allocate returns a reusable page, or grows the file by one.
+func (p *pager) allocate() pageID {
+	if n := len(p.free); n > 0 {
+		id := p.free[n-1]
+		p.free = p.free[:n-1]
+		return id
+	}
+	id := p.pageCount
+	p.pageCount++
+	return id
+}
+
+// release marks pages as free from the next commit on.
+func (p *pager) release(ids ...pageID) {
+	p.pending = append(p.pending, ids...)
+}
+
+// committed makes the pages released before a commit reusable.
+func (p *pager) committed() {
+	p.free = append(p.free, p.pending...)
+	p.pending = p.pending[:0]
+}
+
+func (p *pager) chainLength(payload int) int {
+	capacity := p.pageSize - pageHeaderSize
+	pages := (payload + capacity - 1) / capacity
+	if pages == 0 {
+		pages = 1
+	}
+	return pages
+}
+
+// writeChain stores payload in newly allocated pages and returns the first
+// page and the continuation pages.
+func (p *pager) writeChain(typ byte, payload []byte) (pageID, []pageID, error) {
+	ids := make([]pageID, p.chainLength(len(payload)))
+	for i := range ids {
+		ids[i] = p.allocate()
+	}
+	if err := p.writeChainTo(ids, typ, payload); err != nil {
+		return 0, nil, err
+	}
+	return ids[0], ids[1:], nil
+}
+
+func (p *pager) writeChainTo(ids []pageID, typ byte, payload []byte) error {
+	capacity := p.pageSize - pageHeaderSize
+	for i, id := range ids {
+		chunk := payload
+		if len(chunk) > capacity {
+			chunk = chunk[:capacity]
+		}
+		payload = payload[len(chunk):]
+
+		buf := make([]byte, p.pageSize)
+		buf[0] = typ
+		if i > 0 {
+			buf[0] = pageTypeMore
+		}
+		if i+1 < len(ids) {
+			binary.LittleEndian.PutUint64(buf[1:], ids[i+1])
+		}
+		binary.LittleEndian.PutUint32(buf[9:], uint32(len(chunk)))
+		copy(buf[pageHeaderSize:], chunk)
+		if err := p.writePage(id, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readChain returns the chain type, the payload and the continuation pages
+// of the chain starting at id.
+func (p *pager) readChain(id pageID) (byte, []byte, []pageID, error) {
+	var typ byte
+	var payload []byte
+	var more []pageID
+
+	for i := 0; id != 0; i++ {
+		buf, err := p.readPage(id)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if i == 0 {
+			typ = buf[0]
+		} else {
+			if buf[0] != pageTypeMore || len(more) > int(p.pageCount) {
+				return 0, nil, nil, ErrCorrupted
+			}
+			more = append(more, id)
+		}
+
+		n := int(binary.LittleEndian.Uint32(buf[9:]))
+		if n > p.pageSize-pageHeaderSize {
+			return 0, nil, nil, ErrCorrupted
+		}
+		payload = append(payload, buf[pageHeaderSize:pageHeaderSize+n]...)
+		id = binary.LittleEndian.Uint64(buf[1:])
+	}
+	return typ, payload, more, nil
+}
+
+// writeFreeList stores the ids of every free page, including those released
+// since the last commit, in a new chain. The pages of the chain itself are
+// taken from the free pages before the list is encoded.
+func (p *pager) writeFreeList() (pageID, []pageID, error) {
+	// Each id takes at most 10 bytes as a uvarint, plus the count.
+	n := len(p.free) + len(p.pending)
+	ids := make([]pageID, p.chainLength(binary.MaxVarintLen64*(n+1)))
+	for i := range ids {
+		ids[i] = p.allocate()
+	}
+
+	payload := appendUvarint(nil, uint64(len(p.free)+len(p.pending)))
+	for _, list := range [][]pageID{p.free, p.pending} {
+		for _, id := range list {
+			payload = appendUvarint(payload, id)
+		}
+	}
+	if err := p.writeChainTo(ids, pageTypeFree, payload); err != nil {
+		return 0, nil, err
+	}
+	return ids[0], ids[1:], nil
+}
+
+func (p *pager) readFreeList(id pageID) ([]pageID, error) {
+	typ, payload, more, err := p.readChain(id)
+	if err != nil {
+		return nil, err
+	}
+	if typ != pageTypeFree {
+		return nil, ErrCorrupted
+	}
+
+	r := &byteReader{buf: payload}
+	n := r.uvarint()
+	if r.err != nil || n > p.pageCount {
+		return nil, ErrCorrupted
+	}
+	p.free = make([]pageID, 0, n)
+	for i := uint64(0); i < n; i++ {
+		free := r.uvarint()
+		if r.err != nil || free == 0 || free >= p.pageCount {
+			return nil, ErrCorrupted
+		}
+		p.free = append(p.free, free)
+	}
+	return append([]pageID{id}, more...), nil
+}
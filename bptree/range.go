@@ -0,0 +1,346 @@
+package bptree
+
+// Range calls fn for every key in [start, end] in ascending order, until fn
+// returns false. It descends once to the leaf holding start and then follows
+// the leaf chain. fn must not call into the tree, see Tree.
+func (t *Tree[K, V]) Range(start, end K, fn func(key K, val V) bool) {
+	if t.cmp(start, end) > 0 {
+		return
+	}
+
+	t.rlock()
+	defer t.runlock()
+
+	t.ascend(start, func(key K, val V) bool {
+		if t.cmp(key, end) > 0 {
+			return false
+		}
+		return fn(key, val)
+	})
+}
+
+// Ascend calls fn for every key greater than or equal to start in ascending
+// order, until fn returns false. fn must not call into the tree, see Tree.
+func (t *Tree[K, V]) Ascend(start K, fn func(key K, val V) bool) {
+	t.rlock()
+	defer t.runlock()
+
+	t.ascend(start, fn)
+}
+
+// Descend calls fn for every key less than or equal to start in descending
+// order, until fn returns false. fn must not call into the tree, see Tree.
+func (t *Tree[K, V]) Descend(start K, fn func(key K, val V) bool) {
+	t.rlock()
+	defer t.runlock()
+
+	t.descend(start, fn)
+}
+
+// ascend and descend copy the items of each leaf before they call fn for
+// them, so fn sees the leaf as it was when they reached it, and does not
+// hold its latch.
+func (t *Tree[K, V]) ascend(start K, fn func(key K, val V) bool) {
+	node := t.pin(t.findLeaf(start))
+	keys, values := t.leafItems(node, nil, nil)
+
+	for i := searchKeys(t.cmp, keys, start); ; i = 0 {
+		for ; i < len(keys); i++ {
+			if !fn(keys[i], values[i]) {
+				t.unpin(node)
+				return
+			}
+		}
+		t.unpin(node)
+		if node = t.pin(node.next); node == nil {
+			return
+		}
+		keys, values = t.leafItems(node, keys, values)
+	}
+}
+
+func (t *Tree[K, V]) descend(start K, fn func(key K, val V) bool) {
+	node := t.pin(t.findLastLeaf(start))
+	keys, values := t.leafItems(node, nil, nil)
+
+	for i := searchKeysAfter(t.cmp, keys, start) - 1; ; i = len(keys) - 1 {
+		for ; i >= 0; i-- {
+			if !fn(keys[i], values[i]) {
+				t.unpin(node)
+				return
+			}
+		}
+		t.unpin(node)
+		if node = t.pin(node.prev); node == nil {
+			return
+		}
+		keys, values = t.leafItems(node, keys, values)
+	}
+}
+
+// findLeaf returns the leaf that holds key, or would hold it. For keys above
+// the largest key in the tree that is the last leaf.
+func (t *Tree[K, V]) findLeaf(key K) *bpNode[K, V] {
+	return t.load(t.leafOf(key, false))
+}
+
+// findLastLeaf returns the leaf that holds the last duplicate of key, or
+// the leaf after it. Either way it holds the last key not greater than key
+// or the first key greater than key.
+func (t *Tree[K, V]) findLastLeaf(key K) *bpNode[K, V] {
+	return t.load(t.leafOf(key, true))
+}
+
+// RemoveRange removes every key in [lo, hi] and returns how many it removed.
+// Subtrees that lie inside the range are dropped whole; only the nodes on
+// the paths to lo and hi are trimmed, and then merged with or refilled from
+// their siblings.
+func (t *Tree[K, V]) RemoveRange(lo, hi K) int {
+	if t.cmp(lo, hi) > 0 {
+		return 0
+	}
+
+	t.lock()
+	defer t.unlock()
+
+	// Open transactions need to know which keys went away.
+	var keys []K
+	var removed *[]K
+	if len(t.txns) > 0 {
+		removed = &keys
+	}
+	if t.prepareRange(lo, hi, removed != nil) != nil {
+		return 0
+	}
+	n := t.removeRange(lo, hi, removed)
+	if n > 0 {
+		t.logRemoveRange(lo, hi)
+		t.trackKeys(keys)
+		t.maybeCheckpoint()
+	}
+	return n
+}
+
+// removeRange removes the keys in [lo, hi], adding them to keys unless it
+// is nil, and returns how many it removed.
+func (t *Tree[K, V]) removeRange(lo, hi K, keys *[]K) int {
+	t.root = t.mutable(t.root)
+	n := t.trimNode(t.root, lo, hi, keys)
+	t.count -= n
+
+	if len(t.root.nodes) == 0 && len(t.root.keys) == 0 {
+		t.release(t.root)
+		t.root = newLeafNode[K, V](t.width)
+		t.root.version = t.epoch
+		t.admit(t.root)
+	}
+	t.shrinkRoot()
+	return n
+}
+
+// trimNode removes the keys in [lo, hi] below node. Children inside the
+// range are dropped, at most two children at its ends are trimmed in turn,
+// and fixChildren then restores the fill of what is left.
+func (t *Tree[K, V]) trimNode(node *bpNode[K, V], lo, hi K, keys *[]K) int {
+	if len(node.nodes) == 0 {
+		a, b := node.search(t.cmp, lo), node.searchAfter(t.cmp, hi)
+		if a >= b {
+			return 0
+		}
+		if keys != nil {
+			*keys = append(*keys, node.keys[a:b]...)
+		}
+		node.removeItems(a, b)
+		return b - a
+	}
+
+	// Child i is the first that may hold lo and child j the first with keys
+	// above hi, so the children in between hold only keys in the range.
+	i := node.search(t.cmp, lo)
+	if i == len(node.nodes) {
+		return 0
+	}
+	j := node.searchAfter(t.cmp, hi)
+
+	n := 0
+	if i+1 < j {
+		dropped := node.nodes[i+1 : j]
+		unlinkLeaves(firstLeaf(dropped[0]), lastLeaf(dropped[len(dropped)-1]))
+		for _, child := range dropped {
+			n += child.count()
+			if keys != nil {
+				t.collectKeys(child, keys)
+			}
+			t.releaseTree(child)
+		}
+		node.nodes = append(node.nodes[:i+1], node.nodes[j:]...)
+		node.keys = append(node.keys[:i+1], node.keys[j:]...)
+		j = i + 1
+	}
+	if j < len(node.nodes) && j != i {
+		n += t.trimNode(t.mutableChild(node, j), lo, hi, keys)
+	}
+	n += t.trimNode(t.mutableChild(node, i), lo, hi, keys)
+	if n == 0 {
+		return 0
+	}
+
+	node.size -= int64(n)
+	node.dirty = true
+	t.fixChildren(node)
+	return n
+}
+
+// fixChildren drops the empty children of node and merges or refills those
+// with fewer than half of width entries from their siblings, until every
+// child is at least half full or node has a single child. It then updates
+// the keys of node, since the maxKeys of its children changed.
+func (t *Tree[K, V]) fixChildren(node *bpNode[K, V]) {
+	for p := 0; p < len(node.nodes); {
+		child := node.nodes[p]
+		if entries(child) > 0 {
+			p++
+			continue
+		}
+		if child.leafState != nil {
+			unlinkLeaves(child, child)
+		}
+		node.nodes = append(node.nodes[:p], node.nodes[p+1:]...)
+		node.keys = append(node.keys[:p], node.keys[p+1:]...)
+		t.release(child)
+	}
+
+	for p := 0; p < len(node.nodes) && len(node.nodes) > 1; {
+		if entries(node.nodes[p]) >= t.halfw {
+			p++
+			continue
+		}
+		l := p
+		if l == len(node.nodes)-1 {
+			l--
+		}
+		left, right := t.mutableChild(node, l), t.mutableChild(node, l+1)
+		if entries(left)+entries(right) <= t.width {
+			t.mergeNodes(node, left, right)
+		} else {
+			spreadNodes(left, right)
+		}
+
+		// The children of left and right have new siblings now, so those
+		// left short by the levels below can be fixed. That may in turn
+		// leave left or right short, so look at them again.
+		for k := l; k < l+2 && k < len(node.nodes); k++ {
+			if len(node.nodes[k].nodes) > 0 {
+				t.fixChildren(node.nodes[k])
+			}
+		}
+		p = l
+	}
+	node.rekey()
+}
+
+// mergeNodes appends the entries of right to its left sibling and removes
+// right from parent.
+func (t *Tree[K, V]) mergeNodes(parent, left, right *bpNode[K, V]) {
+	if len(left.nodes) > 0 {
+		left.nodes = append(left.nodes, right.nodes...)
+		left.keys = append(left.keys, right.keys...)
+		left.size += right.size
+	} else {
+		left.keys = append(left.keys, right.keys...)
+		left.values = append(left.values, right.values...)
+		left.next = right.next
+		if right.next != nil {
+			right.next.prev = left
+		}
+	}
+	left.maxKey = right.maxKey
+	left.dirty = true
+	parent.deleteChild(right)
+	t.release(right)
+}
+
+// spreadNodes moves entries between two siblings so that they hold the same
+// number, give or take one.
+func spreadNodes[K any, V any](left, right *bpNode[K, V]) {
+	want := (entries(left) + entries(right)) / 2
+	if len(left.nodes) > 0 {
+		if len(left.nodes) > want {
+			right.nodes = append(append([]*bpNode[K, V](nil), left.nodes[want:]...), right.nodes...)
+			left.nodes = left.nodes[:want]
+		} else {
+			moved := want - len(left.nodes)
+			left.nodes = append(left.nodes, right.nodes[:moved]...)
+			right.nodes = append(right.nodes[:0], right.nodes[moved:]...)
+		}
+		left.recount()
+		right.recount()
+		left.rekey()
+		right.rekey()
+	} else {
+		if len(left.keys) > want {
+			right.keys = append(append(make([]K, 0, cap(right.keys)), left.keys[want:]...), right.keys...)
+			right.values = append(append(make([]V, 0, cap(right.values)), left.values[want:]...), right.values...)
+			left.removeItems(want, len(left.keys))
+		} else {
+			moved := want - len(left.keys)
+			left.keys = append(left.keys, right.keys[:moved]...)
+			left.values = append(left.values, right.values[:moved]...)
+			right.removeItems(0, moved)
+		}
+		left.maxKey = left.keys[len(left.keys)-1]
+	}
+	left.dirty, right.dirty = true, true
+}
+
+// releaseTree frees the pages of node and of every node below it.
+func (t *Tree[K, V]) releaseTree(node *bpNode[K, V]) {
+	if t.store == nil && t.cache == nil {
+		return
+	}
+	for _, child := range node.nodes {
+		t.releaseTree(child)
+	}
+	t.release(node)
+}
+
+// entries returns the number of children or items of node.
+func entries[K any, V any](node *bpNode[K, V]) int {
+	if len(node.nodes) > 0 {
+		return len(node.nodes)
+	}
+	return node.count()
+}
+
+func firstLeaf[K any, V any](node *bpNode[K, V]) *bpNode[K, V] {
+	for len(node.nodes) > 0 {
+		node = node.nodes[0]
+	}
+	return node
+}
+
+func lastLeaf[K any, V any](node *bpNode[K, V]) *bpNode[K, V] {
+	for len(node.nodes) > 0 {
+		node = node.nodes[len(node.nodes)-1]
+	}
+	return node
+}
+
+// unlinkLeaves takes the leaves from first to last out of the leaf chain.
+func unlinkLeaves[K any, V any](first, last *bpNode[K, V]) {
+	if first.prev != nil {
+		first.prev.next = last.next
+	}
+	if last.next != nil {
+		last.next.prev = first.prev
+	}
+}
+
+func (t *Tree[K, V]) collectKeys(node *bpNode[K, V], keys *[]K) {
+	for _, child := range node.nodes {
+		t.collectKeys(child, keys)
+	}
+	if len(node.nodes) == 0 {
+		*keys = append(*keys, t.leafKeys(t.load(node))...)
+	}
+}
@@ -0,0 +1,176 @@
+package bptree
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func randomTree(width, n int) (*BPTree, []int64) {
+	tree := NewBPTree(width)
+	seen := make(map[int64]bool)
+	keys := make([]int64, 0, n)
+	for len(keys) < n {
+		key := rand.Int63n(int64(n) * 4)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+		tree.Set(key, key*10)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return tree, keys
+}
+
+func TestBPTreeRange(t *testing.T) {
+	for _, width := range []int{3, 4, 7, 32} {
+		tree, keys := randomTree(width, 500)
+
+		for i := 0; i < 50; i++ {
+			start := rand.Int63n(2100) - 50
+			end := start + rand.Int63n(400)
+
+			want := make([]int64, 0)
+			for _, key := range keys {
+				if key >= start && key <= end {
+					want = append(want, key)
+				}
+			}
+			got := make([]int64, 0)
+			tree.Range(start, end, func(key int64, val interface{}) bool {
+				if val.(int64) != key*10 {
+					t.Fatalf("width %d: value of %d is %v", width, key, val)
+				}
+				got = append(got, key)
+				return true
+			})
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("width %d: Range(%d, %d) = %v, want %v", width, start, end, got, want)
+			}
+		}
+	}
+}
+
+func TestBPTreeAscendDescend(t *testing.T) {
+	tree, keys := randomTree(4, 300)
+
+	got := make([]int64, 0)
+	tree.Ascend(keys[100], func(key int64, val interface{}) bool {
+		got = append(got, key)
+		return true
+	})
+	if !reflect.DeepEqual(got, keys[100:]) {
+		t.Fatalf("Ascend = %v, want %v", got, keys[100:])
+	}
+
+	got = got[:0]
+	tree.Descend(keys[200], func(key int64, val interface{}) bool {
+		got = append(got, key)
+		return true
+	})
+	want := make([]int64, 0)
+	for i := 200; i >= 0; i-- {
+		want = append(want, keys[i])
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Descend = %v, want %v", got, want)
+	}
+
+	// Both walks stop as soon as fn returns false.
+	count := 0
+	tree.Ascend(keys[0], func(key int64, val interface{}) bool {
+		count++
+		return count < 10
+	})
+	tree.Descend(keys[len(keys)-1], func(key int64, val interface{}) bool {
+		count++
+		return count < 20
+	})
+	if count != 20 {
+		t.Fatalf("walks visited %d keys after stopping, want 20", count)
+	}
+}
+
+func TestBPTreeRangeEmpty(t *testing.T) {
+	tree := NewBPTree(4)
+	tree.Range(0, 100, func(key int64, val interface{}) bool {
+		t.Fatal("empty tree must not yield keys")
+		return true
+	})
+	tree.Descend(100, func(key int64, val interface{}) bool {
+		t.Fatal("empty tree must not yield keys")
+		return true
+	})
+}
+
+func TestRemoveRange(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	for _, width := range []int{3, 4, 5, 8, 16} {
+		for run := 0; run < 40; run++ {
+			tree, keys := randomTree(width, 1+rng.Intn(2000))
+			snap := tree.Snapshot()
+			lo, hi := rng.Int63n(int64(len(keys))*4), rng.Int63n(int64(len(keys))*4)
+			if run%4 == 0 {
+				lo, hi = -1, int64(len(keys))*4
+			}
+
+			want := 0
+			var rest []int64
+			for _, key := range keys {
+				if key >= lo && key <= hi {
+					want++
+				} else {
+					rest = append(rest, key)
+				}
+			}
+			if lo > hi {
+				want, rest = 0, keys
+			}
+			if n := tree.RemoveRange(lo, hi); n != want {
+				t.Fatalf("width %d: RemoveRange(%d, %d) = %d, want %d", width, lo, hi, n, want)
+			}
+			if err := tree.CheckInvariants(); err != nil {
+				t.Fatalf("width %d: RemoveRange(%d, %d): %v", width, lo, hi, err)
+			}
+
+			var got []int64
+			tree.Ascend(-1, func(key int64, val interface{}) bool {
+				got = append(got, key)
+				return true
+			})
+			if !reflect.DeepEqual(got, rest) {
+				t.Fatalf("width %d: RemoveRange(%d, %d) left %d keys, want %d", width, lo, hi, len(got), len(rest))
+			}
+			if snap.Len() != len(keys) {
+				t.Fatalf("width %d: snapshot lost keys", width)
+			}
+			snap.Close()
+
+			// The tree keeps working afterwards.
+			for _, key := range keys[:len(keys)/2] {
+				tree.Set(key, key)
+			}
+			if err := tree.CheckInvariants(); err != nil {
+				t.Fatalf("width %d: Set after RemoveRange: %v", width, err)
+			}
+		}
+	}
+}
+
+func TestRemoveRangeMulti(t *testing.T) {
+	tree := NewMultiTree[int64, int](4, Compare[int64])
+	for i := 0; i < 500; i++ {
+		tree.Add(int64(i%10), i)
+	}
+	if n := tree.RemoveRange(3, 6); n != 200 {
+		t.Fatalf("RemoveRange(3, 6) = %d, want 200", n)
+	}
+	if err := tree.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	if tree.Len() != 300 || len(tree.GetAll(2)) != 50 || len(tree.GetAll(4)) != 0 || len(tree.GetAll(7)) != 50 {
+		t.Fatalf("Len() = %d after RemoveRange", tree.Len())
+	}
+}
@@ -0,0 +1,210 @@
+package bptree
+
+// Snapshot is an immutable view of a tree at the time Snapshot was called.
+// It is read without taking the tree's lock, so long scans do not block
+// writers, and it is safe for concurrent use until Close. Only snapshots of
+// a spill tree or a tree opened from a file take the lock, since reading
+// them may load leaves.
+type Snapshot[K any, V any] struct {
+	tree  *Tree[K, V]
+	root  *bpNode[K, V]
+	count int
+}
+
+// Snapshot returns a consistent read view of the tree.
+//
+// While snapshots are open, writers copy the nodes they change instead of
+// modifying them, together with the path from the root, so each snapshot
+// keeps the version it started with. Old versions are ordinary garbage once
+// the live tree has replaced them and no snapshot references them. Close a
+// snapshot when done, so that writers go back to changing nodes in place.
+func (t *Tree[K, V]) Snapshot() *Snapshot[K, V] {
+	t.lock()
+	defer t.unlock()
+
+	return t.snapshot()
+}
+
+func (t *Tree[K, V]) snapshot() *Snapshot[K, V] {
+	t.epoch++
+	t.snapshots++
+	return &Snapshot[K, V]{tree: t, root: t.root, count: t.count}
+}
+
+// mutable returns node if the tree may change it, or a copy of it that
+// replaces node in the leaf chain if it may be shared with a snapshot.
+// The caller stores the copy in the parent, see mutableChild. Frozen leaves
+// are thawed, or copied in the regular form.
+func (t *Tree[K, V]) mutable(node *bpNode[K, V]) *bpNode[K, V] {
+	t.load(node)
+	if t.snapshots == 0 || node.version == t.epoch {
+		if len(node.nodes) == 0 && node.packed != nil {
+			t.thaw(node)
+		}
+		return node
+	}
+
+	if len(node.nodes) > 0 {
+		clone := newIndexNode[K, V](t.width)
+		clone.maxKey, clone.keys = node.maxKey, append(clone.keys, node.keys...)
+		clone.nodes = append(clone.nodes, node.nodes...)
+		clone.size, clone.version = node.size, t.epoch
+		clone.page, clone.more, clone.dirty = node.page, node.more, node.dirty
+		return clone
+	}
+
+	// The fields are copied one by one to leave the latch behind.
+	clone := allocLeaf[K, V]()
+	clone.maxKey, clone.keys = node.maxKey, t.appendKeys(make([]K, 0, t.width+1), node)
+	clone.next, clone.prev = node.next, node.prev
+	clone.size, clone.version = node.size, t.epoch
+	clone.page, clone.more, clone.dirty = node.page, node.more, node.dirty
+	clone.spilled, clone.lru, clone.pins = node.spilled, node.lru, node.pins
+
+	// Snapshots never follow the leaf chain, so the links of shared
+	// leaves may be redirected to the copy.
+	clone.values = append(make([]V, 0, t.width+1), node.values...)
+	if node.prev != nil {
+		node.prev.next = clone
+	}
+	if node.next != nil {
+		node.next.prev = clone
+	}
+	if t.cache != nil {
+		t.replaceLeaf(node, clone)
+	}
+	return clone
+}
+
+func (t *Tree[K, V]) mutableChild(parent *bpNode[K, V], i int) *bpNode[K, V] {
+	parent.nodes[i] = t.mutable(parent.nodes[i])
+	return parent.nodes[i]
+}
+
+// Close releases the snapshot. It must not be used afterwards.
+func (s *Snapshot[K, V]) Close() {
+	s.tree.lock()
+	defer s.tree.unlock()
+
+	s.release()
+}
+
+func (s *Snapshot[K, V]) release() {
+	if s.root != nil {
+		s.tree.snapshots--
+		s.root, s.count = nil, 0
+		if s.tree.snapshots == 0 && s.tree.cache != nil {
+			s.tree.purgeRetired()
+		}
+	}
+}
+
+// lock takes the tree's lock for reading a snapshot of a spill tree. Other
+// snapshots are read without it, and lock returns false.
+func (s *Snapshot[K, V]) lock() bool {
+	if s.tree.cache == nil {
+		return false
+	}
+	s.tree.lock()
+	return true
+}
+
+// Len returns the number of keys in the snapshot.
+func (s *Snapshot[K, V]) Len() int {
+	return s.count
+}
+
+// Get returns the value of key in the snapshot.
+func (s *Snapshot[K, V]) Get(key K) (V, bool) {
+	if s.lock() {
+		defer s.tree.unlock()
+	}
+
+	var zero V
+	node := s.root
+	if node == nil {
+		return zero, false
+	}
+	for len(node.nodes) > 0 {
+		node = node.nodes[node.findChild(s.tree.cmp, key)]
+	}
+	s.tree.load(node)
+	if i := s.tree.find(node, key); i >= 0 {
+		return node.values[i], true
+	}
+	return zero, false
+}
+
+// Range calls fn for every key in [start, end] in ascending order, until fn
+// returns false.
+func (s *Snapshot[K, V]) Range(start, end K, fn func(key K, val V) bool) {
+	s.Ascend(start, func(key K, val V) bool {
+		return s.tree.cmp(key, end) <= 0 && fn(key, val)
+	})
+}
+
+// Ascend calls fn for every key not less than start in ascending order,
+// until fn returns false.
+func (s *Snapshot[K, V]) Ascend(start K, fn func(key K, val V) bool) {
+	if s.lock() {
+		defer s.tree.unlock()
+	}
+	if s.root != nil {
+		s.ascend(s.root, start, fn)
+	}
+}
+
+// Descend calls fn for every key not greater than start in descending
+// order, until fn returns false.
+func (s *Snapshot[K, V]) Descend(start K, fn func(key K, val V) bool) {
+	if s.lock() {
+		defer s.tree.unlock()
+	}
+	if s.root != nil {
+		s.descend(s.root, start, fn)
+	}
+}
+
+// ascend and descend walk the snapshot from the root down, since the leaf
+// chain only links the leaves of the live tree.
+func (s *Snapshot[K, V]) ascend(node *bpNode[K, V], start K, fn func(key K, val V) bool) bool {
+	cmp := s.tree.cmp
+	if len(node.nodes) > 0 {
+		for i := node.findChild(cmp, start); i < len(node.nodes); i++ {
+			if !s.ascend(node.nodes[i], start, fn) {
+				return false
+			}
+		}
+		return true
+	}
+	s.tree.pin(node)
+	defer s.tree.unpin(node)
+	keys := s.tree.leafKeys(node)
+	for i := searchKeys(cmp, keys, start); i < len(keys); i++ {
+		if !fn(keys[i], node.values[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Snapshot[K, V]) descend(node *bpNode[K, V], start K, fn func(key K, val V) bool) bool {
+	cmp := s.tree.cmp
+	if len(node.nodes) > 0 {
+		for i := node.findLastChild(cmp, start); i >= 0; i-- {
+			if !s.descend(node.nodes[i], start, fn) {
+				return false
+			}
+		}
+		return true
+	}
+	s.tree.pin(node)
+	defer s.tree.unpin(node)
+	keys := s.tree.leafKeys(node)
+	for i := searchKeysAfter(cmp, keys, start) - 1; i >= 0; i-- {
+		if !fn(keys[i], node.values[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+package bptree
+
+import (
+	"math/rand"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func snapshotContents[K comparable, V any](s *Snapshot[K, V], start K) map[K]V {
+	data := make(map[K]V)
+	s.Ascend(start, func(key K, val V) bool {
+		data[key] = val
+		return true
+	})
+	return data
+}
+
+func TestSnapshot(t *testing.T) {
+	tree := NewOrderedTree[int64, int](4)
+	model := make(map[int64]int)
+	for i := int64(0); i < 200; i++ {
+		tree.Set(i*2, int(i))
+		model[i*2] = int(i)
+	}
+
+	snap := tree.Snapshot()
+	defer snap.Close()
+	for i := int64(0); i < 400; i++ {
+		tree.Set(i, -1)
+	}
+	for i := int64(0); i < 400; i += 3 {
+		tree.Remove(i)
+	}
+
+	if snap.Len() != len(model) {
+		t.Fatalf("Len() = %d, want %d", snap.Len(), len(model))
+	}
+	if got := snapshotContents(snap, -1); !reflect.DeepEqual(got, model) {
+		t.Fatalf("snapshot has %d keys, want the %d at the time it was taken", len(got), len(model))
+	}
+	for key, val := range model {
+		if got, ok := snap.Get(key); !ok || got != val {
+			t.Fatalf("Get(%d) = %d, %v, want %d", key, got, ok, val)
+		}
+	}
+	if _, ok := snap.Get(1); ok {
+		t.Fatal("Get(1) found a key set after the snapshot")
+	}
+
+	// The live tree still sees every change through its leaf chain.
+	if err := tree.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	live := treeContents(tree)
+	for i := int64(0); i < 400; i++ {
+		if val, ok := live[i]; ok != (i%3 != 0) || ok && val != -1 {
+			t.Fatalf("live tree has key %d = %d, %v", i, val, ok)
+		}
+	}
+}
+
+func TestSnapshotRange(t *testing.T) {
+	tree := NewOrderedTree[int64, int](5)
+	for i := int64(0); i < 100; i++ {
+		tree.Set(i, int(i))
+	}
+	snap := tree.Snapshot()
+	defer snap.Close()
+	for i := int64(0); i < 100; i++ {
+		tree.Set(i, 0)
+	}
+
+	var keys []int64
+	snap.Range(10, 20, func(key int64, val int) bool {
+		if int64(val) != key {
+			t.Fatalf("key %d = %d", key, val)
+		}
+		keys = append(keys, key)
+		return true
+	})
+	if len(keys) != 11 || keys[0] != 10 || keys[10] != 20 {
+		t.Fatalf("Range(10, 20) = %v", keys)
+	}
+
+	keys = keys[:0]
+	snap.Descend(50, func(key int64, val int) bool {
+		keys = append(keys, key)
+		return len(keys) < 5
+	})
+	if !reflect.DeepEqual(keys, []int64{50, 49, 48, 47, 46}) {
+		t.Fatalf("Descend(50) = %v", keys)
+	}
+}
+
+func TestSnapshotClose(t *testing.T) {
+	tree := NewOrderedTree[int64, int](4)
+	for i := int64(0); i < 100; i++ {
+		tree.Set(i, int(i))
+	}
+
+	snap := tree.Snapshot()
+	old := snap.root
+	reclaimed := make(chan struct{})
+	runtime.SetFinalizer(old, func(*bpNode[int64, int]) { close(reclaimed) })
+	old = nil
+
+	tree.Set(0, -1)
+	if tree.root == snap.root {
+		t.Fatal("writing with an open snapshot must copy the root")
+	}
+	snap.Close()
+	snap.Close()
+	if tree.snapshots != 0 {
+		t.Fatalf("snapshots = %d after Close, want 0", tree.snapshots)
+	}
+
+	// Without snapshots the tree is changed in place again.
+	root := tree.root
+	tree.Set(0, -2)
+	if tree.root != root {
+		t.Fatal("writing without snapshots must not copy the root")
+	}
+
+	// The version only the snapshot referenced is garbage now.
+	for i := 0; i < 50; i++ {
+		runtime.GC()
+		select {
+		case <-reclaimed:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Fatal("the root of a closed snapshot was never reclaimed")
+}
+
+func TestSnapshotConcurrent(t *testing.T) {
+	tree := NewOrderedTree[int64, int](8)
+	for i := int64(0); i < 1000; i++ {
+		tree.Set(i, 0)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 1; ; round++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for i := 0; i < 100; i++ {
+				tree.Set(rand.Int63n(2000), round)
+				tree.Remove(rand.Int63n(2000))
+			}
+		}
+	}()
+
+	// Every key of a snapshot keeps one value however often it is scanned,
+	// while the writer keeps changing the tree.
+	for i := 0; i < 20; i++ {
+		snap := tree.Snapshot()
+		first := snapshotContents(snap, 0)
+		if len(first) != snap.Len() {
+			t.Fatalf("scanned %d keys, Len() = %d", len(first), snap.Len())
+		}
+		if second := snapshotContents(snap, 0); !reflect.DeepEqual(first, second) {
+			t.Fatal("a snapshot changed between two scans")
+		}
+		snap.Close()
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,449 @@
+package bptree
+
+import (
+	"container/list"
+	"fmt"
+	"sync/atomic"
+)
+
+// SpillOptions configures a tree created by NewSpillTree.
+type SpillOptions[K any, V any] struct {
+	// Width is the maximum number of keys or children per node.
+	Width int
+
+	// PageSize is the page size of the spill file, defaulting to 4096
+	// bytes. Leaves larger than a page spill into continuation pages.
+	PageSize int
+
+	Compare    func(a, b K) int
+	KeyCodec   Codec[K]
+	ValueCodec Codec[V]
+
+	// CacheLeaves is the number of leaves kept in memory, defaulting to
+	// 1024.
+	CacheLeaves int
+
+	// FS opens the spill file, defaulting to the os package.
+	FS FS
+}
+
+const defaultCacheLeaves = 1024
+
+// leafCache is the page cache of a paged tree: a spill tree or a tree
+// opened from a file. It lists the leaves whose items are in memory, most recently used
+// first, and writes the items of the least recently used ones to the file
+// once there are more than capacity of them.
+//
+// A leaf in the list may be pinned, which keeps it in memory until it is
+// unpinned. Leaves that were replaced or removed while snapshots share them
+// are retired: they leave the list, stay readable by the snapshots, and
+// their pages are freed once the last snapshot closes.
+type leafCache[K any, V any] struct {
+	pager      *pager
+	keyCodec   Codec[K]
+	valueCodec Codec[V]
+	capacity   int
+	lru        list.List
+	retired    []*bpNode[K, V]
+
+	// Whether the pager is that of a tree opened from a file, whose
+	// committed pages must outlive the next checkpoint, see pager.
+	durable bool
+
+	// The first error writing to or reading from the spill file. Once
+	// writing failed, unwritable is set and leaves are no longer evicted.
+	err        error
+	unwritable bool
+	closed     bool
+}
+
+// loadFailure is the panic value load uses to abandon a read whose leaf
+// cannot be loaded. unlock, runlock and the methods of Iterator recover it,
+// so that the read returns what it found so far. Writes call prepare first
+// and never get there.
+type loadFailure struct{}
+
+// NewSpillTree returns an empty tree that keeps at most opts.CacheLeaves
+// leaves in memory and writes the items of the others to the file at path,
+// loading them back when they are used. Index nodes and the shells of the
+// spilled leaves stay in memory, which takes a small fraction of the space
+// of the items for a reasonable width.
+//
+// The spill file is scratch space: its old contents are discarded and it is
+// not a copy of the tree to reopen. Since even reads may load and evict
+// leaves, a spill tree serializes its readers as well as its writers, and
+// snapshot reads take the tree's lock too. Callbacks and open Iterators
+// must therefore not call into the tree.
+//
+// If a spilled leaf cannot be loaded, because the tree was closed or the
+// file failed, Err reports the error. Writes load every leaf they may change
+// before they change any, so a failed load leaves the tree as it was: Apply
+// and Commit return the error, and the other writes do nothing. Reads stop
+// at the leaf, and return zero values or what they found before it. Get then
+// returns the zero value as for a missing key, and Range and Iterators end
+// early, so callers that need to tell these apart must check Err.
+func NewSpillTree[K any, V any](path string, opts SpillOptions[K, V]) (*Tree[K, V], error) {
+	if opts.Compare == nil || opts.KeyCodec == nil || opts.ValueCodec == nil {
+		return nil, errMissingOption
+	}
+	fs := opts.FS
+	if fs == nil {
+		fs = osFS{}
+	}
+	pageSize := opts.PageSize
+	if pageSize == 0 {
+		pageSize = defaultPageSize
+	} else if pageSize < minPageSize {
+		pageSize = minPageSize
+	}
+	capacity := opts.CacheLeaves
+	if capacity <= 0 {
+		capacity = defaultCacheLeaves
+	}
+
+	file, err := fs.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	tree := NewTree[K, V](opts.Width, opts.Compare)
+	tree.cache = &leafCache[K, V]{
+		pager:      &pager{file: file, pageSize: pageSize, pageCount: 1},
+		keyCodec:   opts.KeyCodec,
+		valueCodec: opts.ValueCodec,
+		capacity:   capacity,
+	}
+	tree.admit(tree.root)
+	return tree, nil
+}
+
+// rlock and runlock guard reads. Reads of a paged tree load and evict
+// leaves, so they take the write lock instead of the read lock.
+func (t *Tree[K, V]) rlock() {
+	if t.cache != nil {
+		t.mu.Lock()
+	} else {
+		t.mu.RLock()
+	}
+}
+
+func (t *Tree[K, V]) runlock() {
+	if t.cache != nil {
+		r := recover()
+		t.unlock()
+		resume(r)
+	} else {
+		t.mu.RUnlock()
+	}
+}
+
+// lock and unlock guard writes. After locking, the keys added by writers
+// that held only the read lock are folded into the count, see updateLatched.
+// Before unlocking, a paged tree evicts the leaves it loaded beyond its
+// capacity, and ends the panic of a leaf that failed to load.
+func (t *Tree[K, V]) lock() {
+	t.mu.Lock()
+	t.count += int(atomic.SwapInt64(&t.added, 0))
+}
+
+func (t *Tree[K, V]) unlock() {
+	var r interface{}
+	if t.cache != nil {
+		r = recover()
+		t.evict()
+	}
+	t.mu.Unlock()
+	resume(r)
+}
+
+// resume goes on with a recovered panic, unless it is a loadFailure.
+func resume(r interface{}) {
+	if _, ok := r.(loadFailure); r != nil && !ok {
+		panic(r)
+	}
+}
+
+// load makes sure the items of a spilled leaf are in memory and marks the
+// leaf as recently used. It returns node, and does nothing for index nodes
+// and for trees that do not spill. If the leaf cannot be loaded, it stays
+// spilled and load abandons the read with a loadFailure.
+func (t *Tree[K, V]) load(node *bpNode[K, V]) *bpNode[K, V] {
+	if err := t.tryLoad(node); err != nil {
+		panic(loadFailure{})
+	}
+	return node
+}
+
+// tryLoad is load returning the error instead. It also records the error
+// for Err, unless there is one already.
+func (t *Tree[K, V]) tryLoad(node *bpNode[K, V]) error {
+	c := t.cache
+	if c == nil || node == nil || node.leafState == nil {
+		return nil
+	}
+	if node.spilled {
+		if c.closed {
+			return c.failed(ErrClosed)
+		}
+		typ, payload, _, err := c.pager.readChain(node.page)
+		if err == nil && typ != pageTypeLeaf {
+			err = ErrCorrupted
+		}
+		var keys []K
+		var values []V
+		if err == nil {
+			keys, values, err = decodeLeaf(payload, t.width, c.keyCodec, c.valueCodec)
+		}
+		if err == nil && len(values) != node.count() {
+			err = ErrCorrupted
+		}
+		if err != nil {
+			return c.failed(fmt.Errorf("bptree: loading a spilled leaf: %w", err))
+		}
+		node.keys, node.values = keys, values
+		node.spilled = false
+	}
+	if node.lru == nil {
+		t.admit(node)
+	} else {
+		c.lru.MoveToFront(node.lru)
+	}
+	return nil
+}
+
+func (c *leafCache[K, V]) failed(err error) error {
+	if c.err == nil {
+		c.err = err
+	}
+	return err
+}
+
+// prepare loads the leaves a write to key may change before the write
+// starts: the leaf of key and, if the write may remove key, the siblings
+// the leaf may take items from or merge with, which are its neighbours in
+// the leaf chain. Loads do not evict, so the leaves stay in memory until
+// the write unlocks the tree. prepare returns the error of a leaf that did
+// not load, and then the write must not start.
+func (t *Tree[K, V]) prepare(key K, removes bool) error {
+	if t.cache == nil {
+		return nil
+	}
+	leaf := t.leafOf(key, false)
+	if err := t.tryLoad(leaf); err != nil || !removes {
+		return err
+	}
+	if err := t.tryLoad(leaf.prev); err != nil {
+		return err
+	}
+	return t.tryLoad(leaf.next)
+}
+
+// prepareBatch is prepare for every operation of a batch.
+func (t *Tree[K, V]) prepareBatch(ops []batchOp[K, V]) error {
+	for _, op := range ops {
+		if err := t.prepare(op.key, op.remove); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareRange is prepare for RemoveRange. It loads the leaves trimNode
+// trims, which it finds by taking the same children, and the neighbours of
+// the first and last of them, which fixChildren may refill them from or
+// merge them with. The leaves in between are dropped whole, and are loaded
+// only if all is set because their keys are needed, see collectKeys.
+func (t *Tree[K, V]) prepareRange(lo, hi K, all bool) error {
+	if t.cache == nil {
+		return nil
+	}
+	var nodes []*bpNode[K, V]
+	t.trimmedLeaves(t.root, lo, hi, &nodes)
+	first, last := t.leafOf(lo, false), t.leafOf(hi, true)
+	nodes = append(nodes, first.prev, last.next)
+	if all && first != last {
+		for node := first.next; node != nil && node != last; node = node.next {
+			nodes = append(nodes, node)
+		}
+	}
+	for _, node := range nodes {
+		if err := t.tryLoad(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trimmedLeaves adds the leaves below node that trimNode trims to leaves.
+func (t *Tree[K, V]) trimmedLeaves(node *bpNode[K, V], lo, hi K, leaves *[]*bpNode[K, V]) {
+	if len(node.nodes) == 0 {
+		*leaves = append(*leaves, node)
+		return
+	}
+	i := node.search(t.cmp, lo)
+	if i == len(node.nodes) {
+		return
+	}
+	if j := node.searchAfter(t.cmp, hi); j < len(node.nodes) && j != i {
+		t.trimmedLeaves(node.nodes[j], lo, hi, leaves)
+	}
+	t.trimmedLeaves(node.nodes[i], lo, hi, leaves)
+}
+
+// leafOf returns the leaf findLeaf returns for key, or findLastLeaf if last
+// is set, without loading it.
+func (t *Tree[K, V]) leafOf(key K, last bool) *bpNode[K, V] {
+	node := t.root
+	for len(node.nodes) > 0 {
+		if last {
+			node = node.nodes[node.findLastChild(t.cmp, key)]
+		} else {
+			node = node.nodes[node.findChild(t.cmp, key)]
+		}
+	}
+	return node
+}
+
+// admit adds a leaf whose items are in memory to the cache.
+func (t *Tree[K, V]) admit(node *bpNode[K, V]) {
+	if t.cache != nil && node.lru == nil {
+		node.lru = t.cache.lru.PushFront(node)
+	}
+}
+
+// pin loads a leaf and keeps it in memory until a matching unpin, for
+// operations that walk many leaves and let the cache evict the others as
+// they go.
+func (t *Tree[K, V]) pin(node *bpNode[K, V]) *bpNode[K, V] {
+	if t.cache != nil && node != nil {
+		t.load(node).pins++
+	}
+	return node
+}
+
+func (t *Tree[K, V]) unpin(node *bpNode[K, V]) {
+	if t.cache != nil && node != nil {
+		node.pins--
+		t.evict()
+	}
+}
+
+// evict spills the least recently used leaves that are neither pinned nor
+// the root until at most capacity leaves are in memory. A leaf of a file
+// that changed since the last checkpoint is written to a free page, and
+// stays dirty so that the checkpoint writes its parent with the new page.
+func (t *Tree[K, V]) evict() {
+	c := t.cache
+	for e := c.lru.Back(); e != nil && c.lru.Len() > c.capacity && !c.unwritable && !c.closed; {
+		node := e.Value.(*bpNode[K, V])
+		e = e.Prev()
+		if node.pins > 0 || node == t.root {
+			continue
+		}
+
+		if node.dirty || node.page == 0 {
+			buf := appendUvarint(nil, uint64(len(node.values)))
+			buf, err := appendItems(buf, t.leafKeys(node), node.values, c.keyCodec, c.valueCodec)
+			if err == nil {
+				c.free(node)
+				node.page, node.more, err = c.pager.writeChain(pageTypeLeaf, buf)
+			}
+			if err != nil {
+				if c.err == nil {
+					c.err = err
+				}
+				c.unwritable = true
+				return
+			}
+			node.dirty = c.durable
+		}
+		c.lru.Remove(node.lru)
+		node.lru = nil
+		node.size = int64(len(node.values))
+		node.keys, node.values, node.packed = nil, nil, nil
+		node.spilled = true
+	}
+}
+
+// replaceLeaf is called when a writer copies a leaf shared with snapshots:
+// the copy takes its place in the cache and node is retired.
+func (t *Tree[K, V]) replaceLeaf(node, clone *bpNode[K, V]) {
+	clone.lru, clone.pins = nil, 0
+	clone.page, clone.more, clone.dirty = 0, nil, true
+	t.retire(node)
+	t.admit(clone)
+}
+
+// dropLeaf removes a leaf that left the tree from the cache and frees its
+// pages, unless a snapshot may still read it.
+func (t *Tree[K, V]) dropLeaf(node *bpNode[K, V]) {
+	if node.leafState == nil {
+		return
+	}
+	if t.snapshots > 0 && node.version < t.epoch {
+		t.retire(node)
+		return
+	}
+	if node.lru != nil {
+		t.cache.lru.Remove(node.lru)
+		node.lru = nil
+	}
+	t.cache.free(node)
+}
+
+func (t *Tree[K, V]) retire(node *bpNode[K, V]) {
+	c := t.cache
+	if node.lru != nil {
+		c.lru.Remove(node.lru)
+		node.lru = nil
+	}
+	c.retired = append(c.retired, node)
+}
+
+// purgeRetired forgets the retired leaves once no snapshot can read them.
+func (t *Tree[K, V]) purgeRetired() {
+	c := t.cache
+	for _, node := range c.retired {
+		if node.lru != nil {
+			c.lru.Remove(node.lru)
+			node.lru = nil
+		}
+		c.free(node)
+	}
+	c.retired = nil
+}
+
+// free makes the pages of node reusable. The spill file only matters while
+// the tree is open, so they can be reused at once, while those of a file are
+// released until the next checkpoint commits.
+func (c *leafCache[K, V]) free(node *bpNode[K, V]) {
+	if node.page == 0 {
+		return
+	}
+	if c.durable {
+		c.pager.release(node.page)
+		c.pager.release(node.more...)
+	} else {
+		c.pager.free = append(c.pager.free, node.page)
+		c.pager.free = append(c.pager.free, node.more...)
+	}
+	node.page, node.more = 0, nil
+}
+
+// close empties and closes the spill file. The tree can no longer load its
+// spilled leaves afterwards.
+func (c *leafCache[K, V]) close() error {
+	if c.closed {
+		return ErrClosed
+	}
+	c.closed = true
+	err := c.pager.file.Truncate(0)
+	if cerr := c.pager.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
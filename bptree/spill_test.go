@@ -0,0 +1,404 @@
+package bptree
+
+import (
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func spillOptions(width, leaves int) SpillOptions[int64, string] {
+	return SpillOptions[int64, string]{
+		Width:       width,
+		PageSize:    minPageSize,
+		Compare:     Compare[int64],
+		KeyCodec:    Int64Codec{},
+		ValueCodec:  StringCodec{},
+		CacheLeaves: leaves,
+	}
+}
+
+// checkSpilled verifies the tree and that it keeps at most its capacity of
+// leaves in memory.
+func checkSpilled(t *testing.T, tree *Tree[int64, string]) {
+	t.Helper()
+	if err := tree.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n := tree.cache.lru.Len(); n > tree.cache.capacity {
+		t.Fatalf("%d leaves in memory, want at most %d", n, tree.cache.capacity)
+	}
+}
+
+func TestSpillTree(t *testing.T) {
+	tree, err := NewSpillTree(filepath.Join(t.TempDir(), "spill"), spillOptions(4, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	rng := rand.New(rand.NewSource(6))
+	model := make(map[int64]string)
+	for op := 0; op < 20000; op++ {
+		key := rng.Int63n(2000)
+		val := strconv.Itoa(op)
+		switch rng.Intn(10) {
+		case 0, 1, 2, 3, 4:
+			tree.Set(key, val)
+			model[key] = val
+		case 5:
+			tree.Update(key, func(old string, exists bool) (string, bool) {
+				return old + "u", true
+			})
+			model[key] += "u"
+		case 6, 7:
+			want, ok := model[key]
+			if got, removed := tree.Remove(key); removed != ok || got != want {
+				t.Fatalf("op %d: Remove(%d) = %q, %v, want %q, %v", op, key, got, removed, want, ok)
+			}
+			delete(model, key)
+		case 8:
+			if op%50 == 0 {
+				tree.RemoveRange(key, key+20)
+				for k := key; k <= key+20; k++ {
+					delete(model, k)
+				}
+			}
+		case 9:
+			if got := tree.Get(key); got != model[key] {
+				t.Fatalf("op %d: Get(%d) = %q, want %q", op, key, got, model[key])
+			}
+		}
+		if op%1000 == 0 {
+			checkSpilled(t, tree)
+		}
+	}
+	checkSpilled(t, tree)
+	if tree.cache.pager.pageCount < 50 {
+		t.Fatalf("the spill file has %d pages, leaves were not spilled", tree.cache.pager.pageCount)
+	}
+
+	if got := treeContents(tree); !reflect.DeepEqual(got, model) {
+		t.Fatalf("tree holds %d keys, want %d", len(got), len(model))
+	}
+	n := 0
+	tree.Descend(2000, func(key int64, val string) bool {
+		if model[key] != val {
+			t.Fatalf("Descend: %d = %q, want %q", key, val, model[key])
+		}
+		n++
+		return true
+	})
+	if n != len(model) {
+		t.Fatalf("Descend visited %d keys, want %d", n, len(model))
+	}
+	if key, _, _ := tree.Select(tree.Rank(1000)); tree.Rank(key) != tree.Rank(1000) {
+		t.Fatalf("Select(Rank(1000)) = %d", key)
+	}
+	checkSpilled(t, tree)
+}
+
+func TestSpillSnapshot(t *testing.T) {
+	tree, err := NewSpillTree(filepath.Join(t.TempDir(), "spill"), spillOptions(4, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	for i := int64(0); i < 500; i++ {
+		tree.Set(i, "a")
+	}
+
+	snap := tree.Snapshot()
+	for i := int64(0); i < 500; i += 2 {
+		tree.Set(i, "b")
+	}
+	tree.RemoveRange(100, 300)
+	checkSpilled(t, tree)
+
+	n := 0
+	snap.Ascend(0, func(key int64, val string) bool {
+		if val != "a" {
+			t.Fatalf("snapshot: %d = %q, want a", key, val)
+		}
+		n++
+		return true
+	})
+	if n != 500 {
+		t.Fatalf("snapshot holds %d keys, want 500", n)
+	}
+	if len(tree.cache.retired) == 0 {
+		t.Fatal("no leaves were retired for the snapshot")
+	}
+	snap.Close()
+	if len(tree.cache.retired) != 0 {
+		t.Fatalf("%d leaves stay retired after the snapshot closed", len(tree.cache.retired))
+	}
+
+	if got := tree.Get(2); got != "b" {
+		t.Fatalf("Get(2) = %q, want b", got)
+	}
+	if tree.Len() != 299 {
+		t.Fatalf("Len() = %d, want 299", tree.Len())
+	}
+	checkSpilled(t, tree)
+}
+
+func TestSpillBulkLoad(t *testing.T) {
+	tree, err := NewSpillTree(filepath.Join(t.TempDir(), "spill"), spillOptions(8, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	i := int64(0)
+	err = tree.BulkLoad(func() (int64, string, bool) {
+		i++
+		return i, strconv.FormatInt(i, 10), i <= 10000
+	}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSpilled(t, tree)
+
+	it := tree.Iterator()
+	want := int64(0)
+	for ok := it.First(); ok; ok = it.Next() {
+		want++
+		if it.Key() != want || it.Value() != strconv.FormatInt(want, 10) {
+			t.Fatalf("iterator at %d = %q, want %d", it.Key(), it.Value(), want)
+		}
+		if n := tree.cache.lru.Len(); n > tree.cache.capacity+1 {
+			t.Fatalf("%d leaves in memory while iterating", n)
+		}
+	}
+	it.Close()
+	if want != 10000 {
+		t.Fatalf("iterated over %d keys, want 10000", want)
+	}
+}
+
+func TestSpillErrors(t *testing.T) {
+	if _, err := NewSpillTree("spill", SpillOptions[int64, string]{}); err != errMissingOption {
+		t.Fatalf("err = %v, want %v", err, errMissingOption)
+	}
+
+	// Opening and truncating the file succeed, writing to it fails. The
+	// tree then keeps every leaf in memory.
+	opts := spillOptions(4, 2)
+	opts.FS = newMemFS(2)
+	tree, err := NewSpillTree("spill", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 100; i++ {
+		tree.Set(i, "a")
+	}
+	if tree.Err() != errCrash {
+		t.Fatalf("Err() = %v, want %v", tree.Err(), errCrash)
+	}
+	if tree.Len() != 100 || tree.Get(99) != "a" {
+		t.Fatal("the tree lost keys after the spill file failed")
+	}
+}
+
+// TestSpillLoadErrors checks that a leaf that cannot be loaded ends the
+// reads that needed it, stops the writes before they change anything, and
+// shows up in Err.
+func TestSpillLoadErrors(t *testing.T) {
+	fs := newMemFS(-1)
+	opts := spillOptions(4, 2)
+	opts.FS = fs
+	tree, err := NewSpillTree("spill", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 100; i++ {
+		tree.Set(i, "a")
+	}
+	checkSpilled(t, tree)
+
+	fs.budget = 0
+	if got := tree.Get(0); got != "" {
+		t.Fatalf("Get(0) = %q with a failing file", got)
+	}
+	if !errors.Is(tree.Err(), errCrash) {
+		t.Fatalf("Err() = %v, want %v", tree.Err(), errCrash)
+	}
+	n := 0
+	tree.Range(0, 100, func(key int64, val string) bool {
+		n++
+		return true
+	})
+	if n >= 100 {
+		t.Fatalf("Range visited %d keys with a failing file", n)
+	}
+	it := tree.Iterator()
+	for ok := it.First(); ok; ok = it.Next() {
+	}
+	it.Close()
+
+	tree.Set(0, "b")
+	if _, removed := tree.Remove(1); removed {
+		t.Fatal("Remove(1) removed a key it could not load")
+	}
+	if n := tree.RemoveRange(2, 50); n != 0 {
+		t.Fatalf("RemoveRange removed %d keys it could not load", n)
+	}
+	var b Batch[int64, string]
+	b.Set(99, "b")
+	b.Remove(0)
+	if err := tree.Apply(&b); !errors.Is(err, errCrash) {
+		t.Fatalf("Apply() = %v, want %v", err, errCrash)
+	}
+
+	// None of the writes happened, and the tree is whole once the file
+	// works again.
+	fs.budget = -1
+	if got := tree.Get(0); got != "a" {
+		t.Fatalf("Get(0) = %q after the file recovered", got)
+	}
+	if tree.Len() != 100 || tree.Get(99) != "a" {
+		t.Fatalf("Len() = %d, Get(99) = %q after failed writes", tree.Len(), tree.Get(99))
+	}
+	if err := tree.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree.Close()
+
+	// A closed tree can no longer load its spilled leaves.
+	tree, err = NewSpillTree("spill", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 100; i++ {
+		tree.Set(i, "a")
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if tree.Get(0) != "" || tree.Err() != ErrClosed {
+		t.Fatalf("Get(0) = %q, Err() = %v after Close", tree.Get(0), tree.Err())
+	}
+}
+
+// TestSpillLoadErrorsAtomic lets the spill file fail after a few more
+// operations while a batch of random writes or a RemoveRange runs, with a
+// transaction open in some rounds. A write that fails must leave the tree
+// as it was.
+func TestSpillLoadErrorsAtomic(t *testing.T) {
+	rng := rand.New(rand.NewSource(8))
+	for round := 0; round < 50; round++ {
+		fs := newMemFS(-1)
+		opts := spillOptions(4, 2)
+		opts.FS = fs
+		tree, err := NewSpillTree("spill", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		model := make(map[int64]string)
+		for i := int64(0); i < 300; i++ {
+			tree.Set(i, "a")
+			model[i] = "a"
+		}
+
+		var tx *Txn[int64, string]
+		if round%4 >= 2 {
+			tx = tree.Begin()
+		}
+		fs.budget = rng.Intn(8)
+		if round%2 == 0 {
+			var b Batch[int64, string]
+			for i := 0; i < 10; i++ {
+				key := rng.Int63n(300)
+				if rng.Intn(2) == 0 {
+					b.Set(key, "b")
+				} else {
+					b.Remove(key)
+				}
+			}
+			if err := tree.Apply(&b); err == nil {
+				for _, op := range b.ops {
+					if op.remove {
+						delete(model, op.key)
+					} else {
+						model[op.key] = op.value
+					}
+				}
+			}
+		} else {
+			lo := rng.Int63n(300)
+			hi := lo + rng.Int63n(100)
+			want := 0
+			if n := tree.RemoveRange(lo, hi); n > 0 {
+				for key := lo; key <= hi; key++ {
+					if _, ok := model[key]; ok {
+						delete(model, key)
+						want++
+					}
+				}
+				if n != want {
+					t.Fatalf("round %d: RemoveRange(%d, %d) = %d, want %d", round, lo, hi, n, want)
+				}
+			}
+		}
+
+		fs.budget = -1
+		if tx != nil {
+			tx.Rollback()
+		}
+		if err := tree.CheckInvariants(); err != nil {
+			t.Fatalf("round %d: %v", round, err)
+		}
+		if got := treeContents(tree); !reflect.DeepEqual(got, model) {
+			t.Fatalf("round %d: tree holds %d keys, want %d", round, len(got), len(model))
+		}
+	}
+}
+
+func TestSpillConcurrent(t *testing.T) {
+	tree, err := NewSpillTree(filepath.Join(t.TempDir(), "spill"), spillOptions(4, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	for i := int64(0); i < 1000; i++ {
+		tree.Set(i, "a")
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		snap := tree.Snapshot()
+		go func(g int, snap *Snapshot[int64, string]) {
+			defer wg.Done()
+			defer snap.Close()
+			rng := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 2000; i++ {
+				key := rng.Int63n(1000)
+				switch rng.Intn(3) {
+				case 0:
+					tree.Set(key, strconv.Itoa(g))
+				case 1:
+					if tree.Get(key) == "" {
+						t.Errorf("Get(%d) lost the key", key)
+						return
+					}
+				case 2:
+					if val, ok := snap.Get(key); !ok || val != "a" {
+						t.Errorf("snapshot Get(%d) = %q, %v", key, val, ok)
+						return
+					}
+				}
+			}
+		}(g, snap)
+	}
+	wg.Wait()
+	checkSpilled(t, tree)
+}
@@ -0,0 +1,128 @@
+package bptree
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Stats describes the shape of a tree.
+type Stats struct {
+	// Height is the number of levels, 1 for a tree that is a single leaf.
+	Height int
+
+	// Nodes holds the number of nodes on each level, root first, so that
+	// the last element is the number of leaves.
+	Nodes []int
+
+	// AvgFill and MinFill are the average and smallest number of entries
+	// per node as a fraction of width. The root is left out unless it is
+	// the only node, since it may hold as little as one key or two
+	// children.
+	AvgFill float64
+	MinFill float64
+
+	// Keys is the number of keys, the same as Len.
+	Keys int
+
+	// Frozen is the number of leaves in the frozen form, see Freeze.
+	Frozen int
+}
+
+// Stats walks the tree and returns its shape. It holds the write lock, so
+// that writers do not change the leaves it counts meanwhile.
+func (t *Tree[K, V]) Stats() Stats {
+	t.lock()
+	defer t.unlock()
+
+	s := Stats{Keys: t.count, MinFill: 1}
+	level := []*bpNode[K, V]{t.root}
+	fills, total := 0, 0
+	for len(level) > 0 {
+		s.Height++
+		s.Nodes = append(s.Nodes, len(level))
+
+		var next []*bpNode[K, V]
+		for _, node := range level {
+			next = append(next, node.nodes...)
+			if len(node.nodes) == 0 && node.packed != nil {
+				s.Frozen++
+			}
+			if node == t.root && len(node.nodes) > 0 {
+				continue
+			}
+			n := entries(node)
+			if fill := float64(n) / float64(t.width); fill < s.MinFill {
+				s.MinFill = fill
+			}
+			fills++
+			total += n
+		}
+		level = next
+	}
+	s.AvgFill = float64(total) / float64(fills*t.width)
+	return s
+}
+
+// DumpDOT writes the tree to w as a Graphviz graph. Index nodes show the
+// maxKey of each child and leaves show their keys; dashed edges follow the
+// next pointers of the leaf chain.
+func (t *Tree[K, V]) DumpDOT(w io.Writer) error {
+	t.rlock()
+	defer t.runlock()
+
+	var buf bytes.Buffer
+	buf.WriteString("digraph bptree {\n\tnode [shape=record];\n")
+
+	ids := make(map[*bpNode[K, V]]int)
+	var leaves []*bpNode[K, V]
+	var dump func(node *bpNode[K, V])
+	dump = func(node *bpNode[K, V]) {
+		id := len(ids)
+		ids[node] = id
+
+		fields := make([]string, 0, entries(node))
+		if len(node.nodes) > 0 {
+			for i, key := range node.keys {
+				fields = append(fields, fmt.Sprintf("<f%d> %s", i, dotEscape(key)))
+			}
+		} else {
+			t.pin(node)
+			t.rlatch(node)
+			for _, key := range t.leafKeys(node) {
+				fields = append(fields, dotEscape(key))
+			}
+			t.runlatch(node)
+			t.unpin(node)
+		}
+		fmt.Fprintf(&buf, "\tn%d [label=\"%s\"];\n", id, strings.Join(fields, "|"))
+
+		for i, child := range node.nodes {
+			fmt.Fprintf(&buf, "\tn%d:f%d -> n%d;\n", id, i, len(ids))
+			dump(child)
+		}
+		if len(node.nodes) == 0 {
+			leaves = append(leaves, node)
+		}
+	}
+	dump(t.root)
+
+	for _, leaf := range leaves {
+		if next, ok := ids[leaf.next]; ok {
+			fmt.Fprintf(&buf, "\tn%d -> n%d [style=dashed, constraint=false];\n", ids[leaf], next)
+		}
+	}
+	buf.WriteString("}\n")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+var dotEscaper = strings.NewReplacer(
+	`\`, `\\`, `"`, `\"`, `|`, `\|`, `{`, `\{`, `}`, `\}`, `<`, `\<`, `>`, `\>`, "\n", `\n`,
+)
+
+func dotEscape(key interface{}) string {
+	return dotEscaper.Replace(fmt.Sprint(key))
+}
@@ -0,0 +1,66 @@
+package bptree
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	tree := NewBPTree(4)
+	if s := tree.Stats(); s.Height != 1 || s.Keys != 0 || s.AvgFill != 0 || s.MinFill != 0 {
+		t.Fatalf("empty tree: %+v", s)
+	}
+
+	if err := tree.BulkLoad(sequence(64), 1); err != nil {
+		t.Fatal(err)
+	}
+	s := tree.Stats()
+	if s.Height != 3 || !reflect.DeepEqual(s.Nodes, []int{1, 4, 16}) || s.Keys != 64 {
+		t.Fatalf("full tree: %+v", s)
+	}
+	if s.AvgFill != 1 || s.MinFill != 1 {
+		t.Fatalf("full tree: fill %v average, %v minimum, want 1", s.AvgFill, s.MinFill)
+	}
+
+	// Removing every other key leaves leaves half full.
+	for i := int64(0); i < 64; i++ {
+		tree.Remove(4 * i)
+	}
+	s = tree.Stats()
+	if s.Keys != 32 || s.MinFill != 0.5 {
+		t.Fatalf("half full tree: %+v", s)
+	}
+}
+
+func TestDumpDOT(t *testing.T) {
+	tree := NewOrderedTree[string, int](3)
+	for _, key := range []string{"a", "b|c", `"d"`, "{e}", "f", "g", "h"} {
+		tree.Set(key, 0)
+	}
+
+	var buf bytes.Buffer
+	if err := tree.DumpDOT(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	t.Log(out)
+
+	s := tree.Stats()
+	nodes := 0
+	for _, n := range s.Nodes {
+		nodes += n
+	}
+	if n := strings.Count(out, "[label="); n != nodes {
+		t.Fatalf("DumpDOT wrote %d nodes, want %d", n, nodes)
+	}
+	if n := strings.Count(out, "style=dashed"); n != s.Nodes[len(s.Nodes)-1]-1 {
+		t.Fatalf("DumpDOT wrote %d leaf links, want %d", n, s.Nodes[len(s.Nodes)-1]-1)
+	}
+	for _, want := range []string{`b\|c`, `\"d\"`, `\{e\}`} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("DumpDOT output lacks %s", want)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package bptree
+
+import "errors"
+
+var (
+	// ErrConflict is returned by Commit when a key the transaction read or
+	// wrote was changed by another commit since the transaction began.
+	ErrConflict = errors.New("bptree: transaction conflicts with a concurrent commit")
+
+	// ErrTxnDone is returned by Commit on a transaction that was already
+	// committed or rolled back.
+	ErrTxnDone = errors.New("bptree: transaction is already done")
+)
+
+// Txn is a transaction on a tree, begun with Begin. It reads from a snapshot
+// taken when it began, merged with its own writes, and buffers its writes
+// until Commit applies them as one batch.
+//
+// Commit detects conflicts optimistically: it fails if any key the
+// transaction read with Get or wrote was changed by another Set, Remove,
+// Apply or Commit after the transaction began. A Txn is not safe for
+// concurrent use.
+type Txn[K any, V any] struct {
+	tree  *Tree[K, V]
+	snap  *Snapshot[K, V]
+	start uint64
+	batch Batch[K, V]
+	done  bool
+
+	// The keys the transaction wrote, with their last batchOp, and the keys
+	// it read. They are kept in trees ordered by the comparator of the tree,
+	// since keys need not be comparable. The values are interfaces because a
+	// Tree[K, batchOp[K, V]] would have transactions of its own, with trees
+	// of batchOp[K, batchOp[K, V]], and so on.
+	writes *Tree[K, interface{}]
+	reads  *Tree[K, interface{}]
+}
+
+// txnWidth is the width of the trees of keys a transaction keeps.
+const txnWidth = 16
+
+// txnCommit records the keys a commit changed while transactions were open.
+type txnCommit[K any] struct {
+	seq  uint64
+	keys []K
+}
+
+// Begin starts a transaction. It must end with Commit or Rollback.
+func (t *Tree[K, V]) Begin() *Txn[K, V] {
+	t.lock()
+	defer t.unlock()
+
+	if t.txns == nil {
+		t.txns = make(map[uint64]int)
+	}
+	t.txns[t.seq]++
+	return &Txn[K, V]{
+		tree:   t,
+		snap:   t.snapshot(),
+		start:  t.seq,
+		writes: NewTree[K, interface{}](txnWidth, t.cmp),
+		reads:  NewTree[K, interface{}](txnWidth, t.cmp),
+	}
+}
+
+// Get returns the value of key as written by the transaction, or else as it
+// was when the transaction began.
+func (tx *Txn[K, V]) Get(key K) (V, bool) {
+	if op, ok := tx.writes.lookup(key); ok {
+		op := op.(batchOp[K, V])
+		return op.value, !op.remove
+	}
+	tx.reads.Set(key, nil)
+	return tx.snap.Get(key)
+}
+
+// Set sets key to value when the transaction commits.
+func (tx *Txn[K, V]) Set(key K, value V) {
+	tx.batch.Set(key, value)
+	tx.writes.Set(key, batchOp[K, V]{key: key, value: value})
+}
+
+// Remove removes key when the transaction commits.
+func (tx *Txn[K, V]) Remove(key K) {
+	tx.batch.Remove(key)
+	tx.writes.Set(key, batchOp[K, V]{key: key, remove: true})
+}
+
+// Commit applies the writes of the transaction atomically, or returns
+// ErrConflict and discards them. Either way the transaction is done. For a
+// tree opened from a file or a spill tree Commit also returns errors like
+// Apply does.
+func (tx *Txn[K, V]) Commit() error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	t := tx.tree
+	t.lock()
+	defer t.unlock()
+	defer tx.end()
+
+	for _, c := range t.commits {
+		if c.seq <= tx.start {
+			continue
+		}
+		for _, key := range c.keys {
+			_, read := tx.reads.lookup(key)
+			_, written := tx.writes.lookup(key)
+			if read || written {
+				return ErrConflict
+			}
+		}
+	}
+
+	if err := t.prepareBatch(tx.batch.ops); err != nil {
+		return err
+	}
+	t.apply(tx.batch.ops)
+	return t.storeErr()
+}
+
+// Rollback discards the writes of the transaction. It does nothing if the
+// transaction is already done, so it can be deferred right after Begin.
+func (tx *Txn[K, V]) Rollback() {
+	if tx.done {
+		return
+	}
+	tx.tree.lock()
+	defer tx.tree.unlock()
+	tx.end()
+}
+
+// end closes the snapshot of the transaction and forgets the commits no
+// open transaction can conflict with any more. The tree lock must be held.
+func (tx *Txn[K, V]) end() {
+	t := tx.tree
+	tx.done = true
+	tx.snap.release()
+
+	if t.txns[tx.start]--; t.txns[tx.start] == 0 {
+		delete(t.txns, tx.start)
+	}
+	if len(t.txns) == 0 {
+		t.commits = nil
+		return
+	}
+	oldest := t.seq
+	for start := range t.txns {
+		if start < oldest {
+			oldest = start
+		}
+	}
+	i := 0
+	for i < len(t.commits) && t.commits[i].seq <= oldest {
+		i++
+	}
+	t.commits = t.commits[i:]
+}
+
+// track and trackBatch count a commit and record its keys while
+// transactions are open. Commits made while none is open are neither
+// counted nor recorded, since no transaction compares against them; that
+// also lets writers that hold only the read lock call track.
+func (t *Tree[K, V]) track(key K) {
+	if len(t.txns) > 0 {
+		t.seq++
+		t.commits = append(t.commits, txnCommit[K]{seq: t.seq, keys: []K{key}})
+	}
+}
+
+func (t *Tree[K, V]) trackBatch(ops []batchOp[K, V]) {
+	var keys []K
+	if len(t.txns) > 0 {
+		keys = make([]K, len(ops))
+		for i, op := range ops {
+			keys[i] = op.key
+		}
+	}
+	t.trackKeys(keys)
+}
+
+func (t *Tree[K, V]) trackKeys(keys []K) {
+	if len(t.txns) > 0 {
+		t.seq++
+		t.commits = append(t.commits, txnCommit[K]{seq: t.seq, keys: keys})
+	}
+}
@@ -0,0 +1,156 @@
+package bptree
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestTxn(t *testing.T) {
+	tree := NewOrderedTree[int64, string](4)
+	tree.Set(1, "one")
+	tree.Set(2, "two")
+
+	tx := tree.Begin()
+	defer tx.Rollback()
+	tx.Set(3, "three")
+	tx.Remove(1)
+
+	// The transaction reads its own writes; the tree does not see them.
+	if val, ok := tx.Get(3); !ok || val != "three" {
+		t.Fatalf("Get(3) = %q, %v, want the uncommitted write", val, ok)
+	}
+	if _, ok := tx.Get(1); ok {
+		t.Fatal("Get(1) found a key the transaction removed")
+	}
+	if val, ok := tx.Get(2); !ok || val != "two" {
+		t.Fatalf("Get(2) = %q, %v", val, ok)
+	}
+	if tree.Len() != 2 {
+		t.Fatalf("Len() = %d before Commit, want 2", tree.Len())
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := treeContents(tree), map[int64]string{2: "two", 3: "three"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("tree = %v, want %v", got, want)
+	}
+	if err := tx.Commit(); err != ErrTxnDone {
+		t.Fatalf("second Commit: err = %v, want %v", err, ErrTxnDone)
+	}
+	if tree.snapshots != 0 || len(tree.txns) != 0 || tree.commits != nil {
+		t.Fatal("a finished transaction must release its snapshot and history")
+	}
+}
+
+func TestTxnRollback(t *testing.T) {
+	tree := NewOrderedTree[int64, string](4)
+	tx := tree.Begin()
+	tx.Set(1, "one")
+	tx.Rollback()
+	tx.Rollback()
+	if tree.Len() != 0 {
+		t.Fatal("Rollback must discard the writes")
+	}
+	if err := tx.Commit(); err != ErrTxnDone {
+		t.Fatalf("Commit after Rollback: err = %v, want %v", err, ErrTxnDone)
+	}
+}
+
+func TestTxnConflict(t *testing.T) {
+	tree := NewOrderedTree[int64, int](4)
+	tree.Set(1, 100)
+	tree.Set(2, 100)
+
+	// Two transactions move money from the same account; the second to
+	// commit read a stale balance.
+	tx1, tx2 := tree.Begin(), tree.Begin()
+	for _, tx := range []*Txn[int64, int]{tx1, tx2} {
+		balance, _ := tx.Get(1)
+		tx.Set(1, balance-10)
+	}
+	if err := tx1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx2.Commit(); err != ErrConflict {
+		t.Fatalf("err = %v, want %v", err, ErrConflict)
+	}
+	if _, val, _ := tree.Floor(1); val != 90 {
+		t.Fatalf("key 1 = %d, want only the first transfer", val)
+	}
+
+	// Writes outside transactions conflict as well, and keys the
+	// transaction never touched do not.
+	tx3 := tree.Begin()
+	tx3.Get(1)
+	tree.Set(2, 0)
+	tx3.Set(3, 0)
+	if err := tx3.Commit(); err != nil {
+		t.Fatalf("unrelated write: err = %v", err)
+	}
+	tx4 := tree.Begin()
+	tx4.Set(2, 1)
+	tree.Set(2, 2)
+	if err := tx4.Commit(); err != ErrConflict {
+		t.Fatalf("blind write after a concurrent Set: err = %v, want %v", err, ErrConflict)
+	}
+}
+
+func TestTxnConcurrent(t *testing.T) {
+	tree := NewOrderedTree[int64, int](8)
+	for i := int64(0); i < 10; i++ {
+		tree.Set(i, 100)
+	}
+
+	// Transfers between random accounts retried on conflict keep the total.
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				from, to := int64((w+i)%10), int64((w*3+i*7+1)%10)
+				if from == to {
+					continue
+				}
+				for {
+					tx := tree.Begin()
+					a, _ := tx.Get(from)
+					b, _ := tx.Get(to)
+					tx.Set(from, a-1)
+					tx.Set(to, b+1)
+					if err := tx.Commit(); err == nil {
+						break
+					} else if err != ErrConflict {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, val := range treeContents(tree) {
+		total += val
+	}
+	if total != 1000 {
+		t.Fatalf("total = %d, want 1000", total)
+	}
+}
+
+func TestTxnRemoveRangeConflict(t *testing.T) {
+	tree := NewOrderedTree[int64, string](4)
+	for i := int64(0); i < 100; i++ {
+		tree.Set(i, "a")
+	}
+	tx := tree.Begin()
+	tx.Get(50)
+	tx.Set(200, "b")
+	tree.RemoveRange(40, 60)
+	if err := tx.Commit(); err != ErrConflict {
+		t.Fatalf("Commit: err = %v, want %v", err, ErrConflict)
+	}
+}
@@ -0,0 +1,143 @@
+package bptree
+
+import "reflect"
+
+// Update calls fn with the value of key and whether key exists, and sets key
+// to the value fn returns if fn also returns true, or removes key if fn
+// returns false. The leaf of key stays locked in between, so fn sees no
+// concurrent writes to key and must not use the tree itself. In a multimap
+// tree Update works on the first value of key.
+func (t *Tree[K, V]) Update(key K, fn func(old V, exists bool) (V, bool)) {
+	change := func(leaf *bpNode[K, V], i int, found bool) int {
+		var old V
+		if found {
+			old = leaf.values[i]
+		}
+		value, keep := fn(old, found)
+		switch {
+		case keep:
+			return t.updateItem(leaf, i, found, key, value)
+		case found:
+			t.logRemove(key)
+			t.track(key)
+			leaf.removeItem(i)
+			return -1
+		}
+		return 0
+	}
+	if t.updateLatched(key, true, change) {
+		return
+	}
+
+	t.lock()
+	defer t.unlock()
+
+	if t.prepare(key, true) != nil {
+		return
+	}
+	t.update(key, change)
+}
+
+// CompareAndSwap sets key to new if its value is old, as compared by
+// reflect.DeepEqual, and reports whether it did. It does nothing if key does
+// not exist.
+func (t *Tree[K, V]) CompareAndSwap(key K, old, new V) bool {
+	swapped := false
+	change := func(leaf *bpNode[K, V], i int, found bool) int {
+		if !found || !reflect.DeepEqual(leaf.values[i], old) {
+			return 0
+		}
+		swapped = true
+		return t.updateItem(leaf, i, found, key, new)
+	}
+	if t.updateLatched(key, false, change) {
+		return swapped
+	}
+
+	t.lock()
+	defer t.unlock()
+
+	if t.prepare(key, false) != nil {
+		return false
+	}
+	t.update(key, change)
+	return swapped
+}
+
+// GetOrSet returns the value of key if it exists. Otherwise it sets key to
+// value and returns value. The result reports whether key existed.
+func (t *Tree[K, V]) GetOrSet(key K, value V) (V, bool) {
+	actual, loaded := value, false
+	change := func(leaf *bpNode[K, V], i int, found bool) int {
+		if found {
+			actual, loaded = leaf.values[i], true
+			return 0
+		}
+		return t.updateItem(leaf, i, found, key, value)
+	}
+	if t.updateLatched(key, false, change) {
+		return actual, loaded
+	}
+
+	t.lock()
+	defer t.unlock()
+
+	if t.prepare(key, false) != nil {
+		var zero V
+		return zero, false
+	}
+	t.update(key, change)
+	return actual, loaded
+}
+
+// updateItem sets the item at index i of leaf, or inserts it there if it
+// was not found, and returns the change in the number of keys.
+func (t *Tree[K, V]) updateItem(leaf *bpNode[K, V], i int, found bool, key K, value V) int {
+	t.logSet(key, value)
+	t.track(key)
+	if found {
+		leaf.values[i] = value
+		leaf.dirty = true
+		return 0
+	}
+	leaf.insertItem(i, key, value)
+	return 1
+}
+
+// update descends once to the leaf that holds key, or would hold it, and
+// calls change with the leaf, the index of the first item not less than key
+// and whether that item has key. change edits the leaf in place and returns
+// 1 if it added an item, -1 if it removed one and 0 otherwise; the nodes on
+// the way back up are then split or merged as for set and remove.
+func (t *Tree[K, V]) update(key K, change func(leaf *bpNode[K, V], i int, found bool) int) {
+	t.root = t.mutable(t.root)
+	t.count += t.updateNode(nil, t.root, key, change)
+	t.shrinkRoot()
+	t.maybeCheckpoint()
+}
+
+func (t *Tree[K, V]) updateNode(parent, node *bpNode[K, V], key K, change func(leaf *bpNode[K, V], i int, found bool) int) int {
+	var delta int
+	if len(node.nodes) > 0 {
+		i := node.findChild(t.cmp, key)
+		delta = t.updateNode(node, t.mutableChild(node, i), key, change)
+		if delta == 0 {
+			return 0
+		}
+		node.size += int64(delta)
+		node.fixKey(i)
+		if len(node.nodes) < t.halfw {
+			t.childMoveOrMerge(parent, node)
+		}
+	} else {
+		i := node.search(t.cmp, key)
+		delta = change(node, i, i < len(node.keys) && t.cmp(node.keys[i], key) == 0)
+		if delta < 0 && len(node.keys) < t.halfw {
+			t.itemMoveOrMerge(parent, node)
+		}
+	}
+	if delta > 0 {
+		t.split(parent, node)
+	}
+	return delta
+}
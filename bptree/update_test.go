@@ -0,0 +1,179 @@
+package bptree
+
+import (
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestUpdate(t *testing.T) {
+	tree := NewBPTree(4)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				tree.Update(int64(i%50), func(old interface{}, exists bool) (interface{}, bool) {
+					if !exists {
+						return 1, true
+					}
+					return old.(int) + 1, true
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	for key := int64(0); key < 50; key++ {
+		if got := tree.Get(key); got != 160 {
+			t.Fatalf("Get(%d) = %v, want 160", key, got)
+		}
+	}
+
+	// Returning false removes the key, or leaves it absent.
+	for key := int64(0); key < 60; key += 2 {
+		tree.Update(key, func(old interface{}, exists bool) (interface{}, bool) {
+			return nil, false
+		})
+	}
+	if tree.Len() != 25 {
+		t.Fatalf("Len() = %d, want 25", tree.Len())
+	}
+	if err := tree.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	tree := NewOrderedTree[int64, []int](4)
+	if tree.CompareAndSwap(1, nil, []int{1}) {
+		t.Fatal("CompareAndSwap set a missing key")
+	}
+	tree.Set(1, []int{1})
+	if tree.CompareAndSwap(1, []int{2}, []int{3}) {
+		t.Fatal("CompareAndSwap swapped an unequal value")
+	}
+	if !tree.CompareAndSwap(1, []int{1}, []int{2}) {
+		t.Fatal("CompareAndSwap did not swap an equal value")
+	}
+	if got := tree.Get(1); !reflect.DeepEqual(got, []int{2}) {
+		t.Fatalf("Get(1) = %v, want [2]", got)
+	}
+}
+
+func TestGetOrSet(t *testing.T) {
+	tree := NewOrderedTree[int64, string](4)
+	if val, loaded := tree.GetOrSet(1, "a"); loaded || val != "a" {
+		t.Fatalf("GetOrSet(1, a) = %q, %v on an empty tree", val, loaded)
+	}
+	if val, loaded := tree.GetOrSet(1, "b"); !loaded || val != "a" {
+		t.Fatalf("GetOrSet(1, b) = %q, %v, want a, true", val, loaded)
+	}
+	if val, ok := tree.Remove(1); !ok || val != "a" {
+		t.Fatalf("Remove(1) = %q, %v, want a, true", val, ok)
+	}
+	if _, ok := tree.Remove(1); ok {
+		t.Fatal("Remove(1) removed a key twice")
+	}
+}
+
+func TestUpdateModel(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	for _, width := range []int{3, 4, 5, 8} {
+		tree := NewOrderedTree[int64, int](width)
+		snap := tree.Snapshot()
+		model := make(map[int64]int)
+
+		for op := 0; op < 5000; op++ {
+			key := rng.Int63n(200)
+			want, ok := model[key]
+			switch rng.Intn(4) {
+			case 0:
+				keep := rng.Intn(3) > 0
+				tree.Update(key, func(old int, exists bool) (int, bool) {
+					if old != want || exists != ok {
+						t.Fatalf("width %d op %d: Update(%d) saw %d, %v", width, op, key, old, exists)
+					}
+					return op, keep
+				})
+				if keep {
+					model[key] = op
+				} else {
+					delete(model, key)
+				}
+			case 1:
+				if tree.CompareAndSwap(key, want, op) != ok {
+					t.Fatalf("width %d op %d: CompareAndSwap(%d) did not report %v", width, op, key, ok)
+				}
+				if ok {
+					model[key] = op
+				}
+			case 2:
+				if val, loaded := tree.GetOrSet(key, op); loaded != ok || ok && val != want {
+					t.Fatalf("width %d op %d: GetOrSet(%d) = %d, %v", width, op, key, val, loaded)
+				}
+				if !ok {
+					model[key] = op
+				}
+			case 3:
+				if val, removed := tree.Remove(key); removed != ok || val != want {
+					t.Fatalf("width %d op %d: Remove(%d) = %d, %v", width, op, key, val, removed)
+				}
+				delete(model, key)
+			}
+
+			if op%500 == 0 {
+				// Keep a snapshot open now and then, so that the updates
+				// copy shared nodes.
+				snap.Close()
+				snap = tree.Snapshot()
+			}
+			if err := tree.CheckInvariants(); err != nil {
+				t.Fatalf("width %d op %d: %v", width, op, err)
+			}
+		}
+		snap.Close()
+
+		if got := treeContents(tree); !reflect.DeepEqual(got, model) {
+			t.Fatalf("width %d: tree and model differ", width)
+		}
+	}
+}
+
+func TestUpdateReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.db")
+	opts := stringOptions(4, 0)
+	tree, err := Open(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 100; i++ {
+		tree.GetOrSet(i, "a")
+	}
+	for i := int64(0); i < 100; i += 2 {
+		tree.Update(i, func(old string, exists bool) (string, bool) {
+			return old + "b", i%4 == 0
+		})
+	}
+	tree.CompareAndSwap(1, "a", "c")
+	tree.Remove(3)
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	model := treeContents(tree)
+
+	reopened, err := Open(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if got := treeContents(reopened); !reflect.DeepEqual(got, model) {
+		t.Fatalf("replayed %d keys, want %d", len(got), len(model))
+	}
+	if got := reopened.Get(4); got != "ab" {
+		t.Fatalf("Get(4) = %q, want ab", got)
+	}
+}
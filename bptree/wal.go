@@ -0,0 +1,168 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"time"
+)
+
+// SyncPolicy decides when the write-ahead log of a disk tree is synced to
+// stable storage.
+type SyncPolicy int
+
+const (
+	// SyncAlways syncs the log after every Set or Remove, so each of them
+	// is durable when it returns.
+	SyncAlways SyncPolicy = iota
+
+	// SyncInterval syncs the log at most once per Options.SyncInterval.
+	// A crash can lose the changes of the last interval.
+	SyncInterval
+
+	// SyncNone leaves syncing to Flush, Checkpoint and Close.
+	SyncNone
+)
+
+const (
+	walOpSet    byte = 1
+	walOpRemove byte = 2
+	walOpBatch  byte = 3
+
+	// The key of a range record is its first key and the value its last.
+	walOpRemoveRange byte = 4
+
+	// crc u32 | length u32 | lsn u64 | op u8
+	walRecordHeader = 4 + 4 + 8 + 1
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// wal is a redo log of the Set and Remove calls since the last checkpoint.
+// Each record carries a checksum, so a record torn by a crash ends the log.
+//
+//	crc u32 | length u32 | lsn u64 | op u8 | key | value
+//
+// The key and value are uvarint length-prefixed; the checksum covers
+// everything after itself, and length is the size of lsn, op, key and value.
+type wal struct {
+	file     File
+	size     int64
+	lsn      uint64
+	policy   SyncPolicy
+	interval time.Duration
+	lastSync time.Time
+	unsynced bool
+	now      func() time.Time
+}
+
+func (w *wal) append(op byte, key, val []byte) error {
+	body := make([]byte, 8+1, 8+1+len(key)+len(val)+2*binary.MaxVarintLen64)
+	binary.LittleEndian.PutUint64(body, w.lsn+1)
+	body[8] = op
+	body = appendUvarint(body, uint64(len(key)))
+	body = append(body, key...)
+	body = appendUvarint(body, uint64(len(val)))
+	body = append(body, val...)
+
+	rec := make([]byte, 8, 8+len(body))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(len(body)))
+	rec = append(rec, body...)
+	binary.LittleEndian.PutUint32(rec, crc32.Checksum(rec[4:], crcTable))
+
+	if _, err := w.file.WriteAt(rec, w.size); err != nil {
+		return err
+	}
+	w.size += int64(len(rec))
+	w.lsn++
+	w.unsynced = true
+
+	switch w.policy {
+	case SyncAlways:
+		return w.sync()
+	case SyncInterval:
+		if w.now().Sub(w.lastSync) >= w.interval {
+			return w.sync()
+		}
+	}
+	return nil
+}
+
+func (w *wal) sync() error {
+	if !w.unsynced {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.unsynced = false
+	w.lastSync = w.now()
+	return nil
+}
+
+// replay calls fn for every intact record in the log, then cuts the log
+// after the last of them so that new records follow it directly.
+func (w *wal) replay(fn func(lsn uint64, op byte, key, val []byte) error) error {
+	size, err := w.file.Size()
+	if err != nil {
+		return err
+	}
+
+	var off int64
+	header := make([]byte, 8)
+	for off+walRecordHeader <= size {
+		if _, err := w.file.ReadAt(header, off); err != nil {
+			return err
+		}
+		n := int64(binary.LittleEndian.Uint32(header[4:]))
+		if n < 9 || off+8+n > size {
+			break
+		}
+		rec := make([]byte, 4+n)
+		if _, err := w.file.ReadAt(rec, off+4); err != nil {
+			return err
+		}
+		if crc32.Checksum(rec, crcTable) != binary.LittleEndian.Uint32(header) {
+			break
+		}
+
+		body := rec[4:]
+		lsn := binary.LittleEndian.Uint64(body)
+		r := &byteReader{buf: body[9:]}
+		key := r.bytes()
+		val := r.bytes()
+		if r.err != nil {
+			break
+		}
+		if err := fn(lsn, body[8], key, val); err != nil {
+			return err
+		}
+		if lsn > w.lsn {
+			w.lsn = lsn
+		}
+		off += 8 + n
+	}
+
+	if off != size {
+		if err := w.file.Truncate(off); err != nil {
+			return err
+		}
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+	}
+	w.size = off
+	return nil
+}
+
+// reset empties the log once a checkpoint made its records redundant.
+func (w *wal) reset() error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.size = 0
+	w.unsynced = false
+	return nil
+}
@@ -0,0 +1,340 @@
+package bptree
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var errCrash = errors.New("crash")
+
+// memFS keeps files in memory and remembers which writes were synced. Once
+// budget operations have run it crashes: that operation and every later one
+// fail. crashImage then builds the files a machine would find after a
+// reboot.
+type memFS struct {
+	files  map[string]*memFile
+	budget int
+}
+
+func newMemFS(budget int) *memFS {
+	return &memFS{files: make(map[string]*memFile), budget: budget}
+}
+
+func (fs *memFS) OpenFile(name string) (File, error) {
+	if err := fs.step(); err != nil {
+		return nil, err
+	}
+	file, ok := fs.files[name]
+	if !ok {
+		file = &memFile{fs: fs}
+		fs.files[name] = file
+	}
+	return file, nil
+}
+
+func (fs *memFS) step() error {
+	if fs.budget == 0 {
+		return errCrash
+	}
+	if fs.budget > 0 {
+		fs.budget--
+	}
+	return nil
+}
+
+// crashImage keeps the synced contents of each file plus a random prefix of
+// the writes since, the last of which may be torn.
+func (fs *memFS) crashImage(rng *rand.Rand) *memFS {
+	image := newMemFS(-1)
+	for name, file := range fs.files {
+		data := append([]byte(nil), file.synced...)
+		n := rng.Intn(len(file.pending) + 1)
+		for i, op := range file.pending[:n] {
+			if op.truncate {
+				data = resize(data, op.off)
+				continue
+			}
+			buf := op.data
+			if i == n-1 {
+				buf = buf[:rng.Intn(len(buf)+1)]
+			}
+			data = writeAt(data, buf, op.off)
+		}
+		image.files[name] = &memFile{fs: image, data: data, synced: append([]byte(nil), data...)}
+	}
+	return image
+}
+
+type memFile struct {
+	fs      *memFS
+	data    []byte
+	synced  []byte
+	pending []memOp
+}
+
+type memOp struct {
+	truncate bool
+	off      int64
+	data     []byte
+}
+
+func (f *memFile) ReadAt(buf []byte, off int64) (int, error) {
+	if err := f.fs.step(); err != nil {
+		return 0, err
+	}
+	if off >= int64(len(f.data)) {
+		return 0, errors.New("EOF")
+	}
+	n := copy(buf, f.data[off:])
+	if n < len(buf) {
+		return n, errors.New("EOF")
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(buf []byte, off int64) (int, error) {
+	if err := f.fs.step(); err != nil {
+		return 0, err
+	}
+	f.data = writeAt(f.data, buf, off)
+	f.pending = append(f.pending, memOp{off: off, data: append([]byte(nil), buf...)})
+	return len(buf), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if err := f.fs.step(); err != nil {
+		return err
+	}
+	f.data = resize(f.data, size)
+	f.pending = append(f.pending, memOp{truncate: true, off: size})
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	if err := f.fs.step(); err != nil {
+		return err
+	}
+	f.synced = append(f.synced[:0], f.data...)
+	f.pending = nil
+	return nil
+}
+
+func (f *memFile) Size() (int64, error) {
+	if err := f.fs.step(); err != nil {
+		return 0, err
+	}
+	return int64(len(f.data)), nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+func resize(data []byte, size int64) []byte {
+	if size <= int64(len(data)) {
+		return data[:size]
+	}
+	return append(data, make([]byte, size-int64(len(data)))...)
+}
+
+func writeAt(data, buf []byte, off int64) []byte {
+	if end := off + int64(len(buf)); end > int64(len(data)) {
+		data = resize(data, end)
+	}
+	copy(data[off:], buf)
+	return data
+}
+
+func TestWALReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.db")
+	opts := stringOptions(4, 0)
+	opts.Sync = SyncNone
+
+	tree, err := Open(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := make(map[int64]string)
+	for i := int64(0); i < 300; i++ {
+		tree.Set(i, "a")
+		model[i] = "a"
+	}
+	for i := int64(0); i < 300; i += 3 {
+		tree.Remove(i)
+		delete(model, i)
+	}
+	tree.RemoveRange(100, 150)
+	for i := int64(100); i <= 150; i++ {
+		delete(model, i)
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tree is never closed, so its changes exist only in the log.
+	reopened, err := Open(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := treeContents(reopened); !reflect.DeepEqual(got, model) {
+		t.Fatalf("replayed %d keys, want %d", len(got), len(model))
+	}
+
+	// New records continue after the replayed ones.
+	reopened.Set(1000, "b")
+	model[1000] = "b"
+	if err := reopened.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	again, err := Open(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if got := treeContents(again); !reflect.DeepEqual(got, model) {
+		t.Fatalf("replayed %d keys, want %d", len(got), len(model))
+	}
+}
+
+func TestWALTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.db")
+	tree, err := Open(path, stringOptions(4, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Set(1, "one")
+	tree.Set(2, "two")
+	size := tree.store.wal.size
+
+	// A half-written record after the intact ones is dropped.
+	file, err := os.OpenFile(path+".wal", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte{1, 2, 3, 4, 40, 0, 0, 0, 9}); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	reopened, err := Open(path, stringOptions(4, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if got := treeContents(reopened); !reflect.DeepEqual(got, map[int64]string{1: "one", 2: "two"}) {
+		t.Fatalf("replayed %v", got)
+	}
+	if reopened.store.wal.size != size {
+		t.Fatalf("log size = %d, want the torn record cut to %d", reopened.store.wal.size, size)
+	}
+}
+
+func TestWALSyncInterval(t *testing.T) {
+	now := time.Unix(0, 0)
+	file := &memFile{fs: newMemFS(-1)}
+	w := wal{file: file, policy: SyncInterval, interval: time.Second, lastSync: now, now: func() time.Time { return now }}
+
+	if err := w.append(walOpSet, []byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if len(file.synced) != 0 {
+		t.Fatal("a record within the interval must not be synced")
+	}
+	now = now.Add(time.Second)
+	if err := w.append(walOpSet, []byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(file.synced)) != w.size {
+		t.Fatal("a record after the interval must sync the log")
+	}
+}
+
+// TestCrashRecovery crashes a tree at every point of a random workload and
+// checks that reopening the files recovers either the state before the
+// operation that crashed or the state after it. A cache of two leaves also
+// makes the tree load leaves from the file and evict dirty ones between
+// checkpoints.
+func TestCrashRecovery(t *testing.T) {
+	for _, leaves := range []int{0, 2} {
+		t.Run(fmt.Sprintf("leaves=%d", leaves), func(t *testing.T) {
+			testCrashRecovery(t, leaves)
+		})
+	}
+}
+
+func testCrashRecovery(t *testing.T, leaves int) {
+	rng := rand.New(rand.NewSource(1))
+	ops := 300
+	if testing.Short() {
+		ops = 100
+	}
+
+	for budget := 1; ; budget += 7 {
+		fs := newMemFS(budget)
+		opts := stringOptions(4, minPageSize)
+		opts.FS = fs
+		opts.CheckpointSize = 2048
+		opts.CacheLeaves = leaves
+
+		states := []map[int64]string{{}}
+		model := make(map[int64]string)
+		finished := false
+
+		tree, err := Open("tree.db", opts)
+		if err == nil {
+			for i := 0; i < ops; i++ {
+				key := rng.Int63n(64)
+				if rng.Intn(3) == 0 {
+					tree.Remove(key)
+					delete(model, key)
+				} else {
+					val := string(rune('a' + rng.Intn(26)))
+					tree.Set(key, val)
+					model[key] = val
+				}
+				after := make(map[int64]string, len(model))
+				for k, v := range model {
+					after[k] = v
+				}
+
+				if tree.Err() != nil {
+					states = append(states[len(states)-1:], after)
+					break
+				}
+				states = []map[int64]string{after}
+			}
+			if tree.Err() == nil {
+				finished = tree.Close() == nil
+			}
+		}
+
+		for i := 0; i < 3; i++ {
+			opts.FS = fs.crashImage(rng)
+			reopened, err := Open("tree.db", opts)
+			if err != nil {
+				t.Fatalf("budget %d: reopen: %v", budget, err)
+			}
+			got := treeContents(reopened)
+			ok := false
+			for _, state := range states {
+				ok = ok || reflect.DeepEqual(got, state)
+			}
+			if !ok {
+				t.Fatalf("budget %d: recovered %d keys, want one of %d states", budget, len(got), len(states))
+			}
+			if reopened.Len() != len(got) {
+				t.Fatalf("budget %d: Len() = %d, want %d", budget, reopened.Len(), len(got))
+			}
+		}
+		if finished {
+			t.Logf("crashed at %d points", budget/7)
+			return
+		}
+	}
+}
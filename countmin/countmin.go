@@ -0,0 +1,232 @@
+package countmin
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/Pangjiping/goutils/bloom"
+)
+
+// CountMinSketch estimates per-key counts of a stream in fixed memory.
+//
+// It keeps depth rows of width counters; a key increments one counter per
+// row and its estimate is the minimum of those counters. Estimates never
+// undercount, and with width = ceil(e/epsilon) and depth = ceil(ln(1/delta))
+// they overcount by more than epsilon*Total() with probability at most delta.
+type CountMinSketch struct {
+	counters     []uint64
+	width        uint32
+	depth        uint32
+	total        uint64
+	conservative bool
+}
+
+var (
+	// ErrDimensionMismatch is returned when merging sketches of different sizes.
+	ErrDimensionMismatch = errors.New("countmin: sketch dimensions do not match")
+
+	// ErrInvalidData is returned by UnmarshalBinary for malformed input.
+	ErrInvalidData = errors.New("countmin: invalid serialized sketch")
+
+	// ErrUnsupportedVersion is returned by UnmarshalBinary for input written
+	// by a newer, incompatible format version.
+	ErrUnsupportedVersion = errors.New("countmin: unsupported format version")
+)
+
+// Option configures a CountMinSketch.
+type Option func(sketch *CountMinSketch)
+
+// WithConservativeUpdate makes Add raise only the counters that are below
+// the new estimate of the key, which noticeably lowers the overestimation
+// for skewed streams.
+func WithConservativeUpdate() Option {
+	return func(sketch *CountMinSketch) {
+		sketch.conservative = true
+	}
+}
+
+// NewCountMinSketch returns a sketch with depth rows of width counters.
+func NewCountMinSketch(width, depth uint32, opts ...Option) *CountMinSketch {
+	if width == 0 {
+		width = 1
+	}
+	if depth == 0 {
+		depth = 1
+	}
+
+	sketch := &CountMinSketch{
+		counters: make([]uint64, int(width)*int(depth)),
+		width:    width,
+		depth:    depth,
+	}
+	for _, opt := range opts {
+		opt(sketch)
+	}
+	return sketch
+}
+
+// NewCountMinSketchWithEstimates sizes the sketch so that an estimate exceeds
+// the true count by more than epsilon*Total() with probability at most delta.
+// It panics unless epsilon > 0 and 0 < delta < 1, and if epsilon is so small
+// that a row would need more than 2^32-1 counters.
+func NewCountMinSketchWithEstimates(epsilon, delta float64, opts ...Option) *CountMinSketch {
+	if !(epsilon > 0) || !(delta > 0 && delta < 1) {
+		panic("countmin: epsilon must be positive and delta between 0 and 1")
+	}
+	if math.Ceil(math.E/epsilon) > math.MaxUint32 {
+		panic("countmin: epsilon is too small")
+	}
+	width := uint32(math.Ceil(math.E / epsilon))
+	depth := uint32(math.Ceil(math.Log(1 / delta)))
+	return NewCountMinSketch(width, depth, opts...)
+}
+
+// Add counts n more occurrences of key.
+func (sketch *CountMinSketch) Add(key string, n uint64) {
+	sketch.total += n
+	h1, h2 := sketch.hashes(key)
+
+	if !sketch.conservative {
+		for row := uint32(0); row < sketch.depth; row++ {
+			sketch.counters[sketch.index(row, h1, h2)] += n
+		}
+		return
+	}
+
+	estimate := sketch.estimate(h1, h2) + n
+	for row := uint32(0); row < sketch.depth; row++ {
+		i := sketch.index(row, h1, h2)
+		if sketch.counters[i] < estimate {
+			sketch.counters[i] = estimate
+		}
+	}
+}
+
+// Estimate returns an upper bound of the number of occurrences of key.
+func (sketch *CountMinSketch) Estimate(key string) uint64 {
+	h1, h2 := sketch.hashes(key)
+	return sketch.estimate(h1, h2)
+}
+
+// Total returns the sum of all counts added to the sketch.
+func (sketch *CountMinSketch) Total() uint64 {
+	return sketch.total
+}
+
+// Width returns the number of counters per row.
+func (sketch *CountMinSketch) Width() uint32 {
+	return sketch.width
+}
+
+// Depth returns the number of rows.
+func (sketch *CountMinSketch) Depth() uint32 {
+	return sketch.depth
+}
+
+// Merge adds the counts of other, which must have the same dimensions, into
+// the sketch. The result estimates the combined stream of both sketches.
+func (sketch *CountMinSketch) Merge(other *CountMinSketch) error {
+	if sketch.width != other.width || sketch.depth != other.depth {
+		return ErrDimensionMismatch
+	}
+	for i, count := range other.counters {
+		sketch.counters[i] += count
+	}
+	sketch.total += other.total
+	return nil
+}
+
+// Reset sets every counter back to zero.
+func (sketch *CountMinSketch) Reset() {
+	for i := range sketch.counters {
+		sketch.counters[i] = 0
+	}
+	sketch.total = 0
+}
+
+func (sketch *CountMinSketch) estimate(h1, h2 uint32) uint64 {
+	min := uint64(math.MaxUint64)
+	for row := uint32(0); row < sketch.depth; row++ {
+		if count := sketch.counters[sketch.index(row, h1, h2)]; count < min {
+			min = count
+		}
+	}
+	return min
+}
+
+// hashes splits a single 64-bit hash into the two halves used to derive the
+// row hashes as h1 + row*h2.
+func (sketch *CountMinSketch) hashes(key string) (uint32, uint32) {
+	hash := bloom.Hash64(key)
+	return uint32(hash), uint32(hash>>32) | 1
+}
+
+func (sketch *CountMinSketch) index(row, h1, h2 uint32) int {
+	col := (h1 + row*h2) % sketch.width
+	return int(row)*int(sketch.width) + int(col)
+}
+
+// The serialized form is a fixed header followed by the counters, row by
+// row, all little-endian:
+//
+//	magic "CMSK" | version u8 | flags u8 | width u32 | depth u32 | total u64
+const (
+	binaryMagic   = "CMSK"
+	binaryVersion = 1
+	headerSize    = 4 + 1 + 1 + 4 + 4 + 8
+
+	flagConservative = 1 << 0
+)
+
+// MarshalBinary encodes the sketch into its versioned binary form.
+func (sketch *CountMinSketch) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, headerSize+8*len(sketch.counters))
+	copy(buf, binaryMagic)
+	buf[4] = binaryVersion
+	if sketch.conservative {
+		buf[5] |= flagConservative
+	}
+	binary.LittleEndian.PutUint32(buf[6:], sketch.width)
+	binary.LittleEndian.PutUint32(buf[10:], sketch.depth)
+	binary.LittleEndian.PutUint64(buf[14:], sketch.total)
+
+	for i, count := range sketch.counters {
+		binary.LittleEndian.PutUint64(buf[headerSize+8*i:], count)
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary replaces the sketch with one decoded from data.
+func (sketch *CountMinSketch) UnmarshalBinary(data []byte) error {
+	if len(data) < headerSize || string(data[:4]) != binaryMagic {
+		return ErrInvalidData
+	}
+	if data[4] != binaryVersion {
+		return ErrUnsupportedVersion
+	}
+
+	decoded := CountMinSketch{
+		conservative: data[5]&flagConservative != 0,
+		width:        binary.LittleEndian.Uint32(data[6:]),
+		depth:        binary.LittleEndian.Uint32(data[10:]),
+		total:        binary.LittleEndian.Uint64(data[14:]),
+	}
+	if decoded.width == 0 || decoded.depth == 0 {
+		return ErrInvalidData
+	}
+	// The body is compared in counters rather than bytes, since 8*n can
+	// wrap around for a huge width and depth.
+	n := uint64(decoded.width) * uint64(decoded.depth)
+	body := uint64(len(data) - headerSize)
+	if body%8 != 0 || body/8 != n {
+		return ErrInvalidData
+	}
+
+	decoded.counters = make([]uint64, n)
+	for i := range decoded.counters {
+		decoded.counters[i] = binary.LittleEndian.Uint64(data[headerSize+8*i:])
+	}
+	*sketch = decoded
+	return nil
+}
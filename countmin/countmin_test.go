@@ -0,0 +1,163 @@
+package countmin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func zipfStream(n int) map[string]uint64 {
+	r := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(r, 1.2, 1, 10000)
+	counts := make(map[string]uint64)
+	for i := 0; i < n; i++ {
+		counts[fmt.Sprintf("key%d", zipf.Uint64())]++
+	}
+	return counts
+}
+
+func TestCountMinSketch(t *testing.T) {
+	sketch := NewCountMinSketch(1024, 4)
+	sketch.Add("aaa", 3)
+	sketch.Add("bbb", 1)
+	sketch.Add("aaa", 2)
+
+	if got := sketch.Estimate("aaa"); got < 5 {
+		t.Fatalf("Estimate(aaa) = %d, want >= 5", got)
+	}
+	if got := sketch.Estimate("bbb"); got < 1 {
+		t.Fatalf("Estimate(bbb) = %d, want >= 1", got)
+	}
+	if sketch.Total() != 6 {
+		t.Fatalf("Total() = %d, want 6", sketch.Total())
+	}
+}
+
+func TestCountMinSketchErrorBound(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "Standard"},
+		{name: "Conservative", opts: []Option{WithConservativeUpdate()}},
+	}
+	counts := zipfStream(200000)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sketch := NewCountMinSketchWithEstimates(0.001, 0.01, tt.opts...)
+			for key, n := range counts {
+				sketch.Add(key, n)
+			}
+
+			bound := uint64(0.001 * float64(sketch.Total()))
+			violations := 0
+			var overcount uint64
+			for key, n := range counts {
+				estimate := sketch.Estimate(key)
+				if estimate < n {
+					t.Fatalf("Estimate(%s) = %d undercounts %d", key, estimate, n)
+				}
+				if estimate-n > bound {
+					violations++
+				}
+				overcount += estimate - n
+			}
+			t.Logf("%dx%d, total overcount %d, violations %d/%d",
+				sketch.Width(), sketch.Depth(), overcount, violations, len(counts))
+			if float64(violations) > 0.01*float64(len(counts)) {
+				t.Fatalf("%d of %d estimates exceed the error bound", violations, len(counts))
+			}
+		})
+	}
+}
+
+func TestCountMinSketchWithEstimatesInvalid(t *testing.T) {
+	for _, tt := range []struct{ epsilon, delta float64 }{
+		{0, 0.01}, {-0.1, 0.01}, {math.NaN(), 0.01}, {1e-12, 0.01},
+		{0.01, 0}, {0.01, 1}, {0.01, 1.5}, {0.01, math.NaN()},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("epsilon %v, delta %v: no panic", tt.epsilon, tt.delta)
+				}
+			}()
+			NewCountMinSketchWithEstimates(tt.epsilon, tt.delta)
+		}()
+	}
+
+	sketch := NewCountMinSketchWithEstimates(0.5, 0.9)
+	if sketch.width != 6 || sketch.depth != 1 {
+		t.Fatalf("width = %d, depth = %d, want 6, 1", sketch.width, sketch.depth)
+	}
+}
+
+func TestCountMinSketchMerge(t *testing.T) {
+	a := NewCountMinSketch(512, 5)
+	b := NewCountMinSketch(512, 5)
+	a.Add("aaa", 10)
+	b.Add("aaa", 5)
+	b.Add("bbb", 7)
+
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	if got := a.Estimate("aaa"); got < 15 {
+		t.Fatalf("Estimate(aaa) = %d, want >= 15", got)
+	}
+	if got := a.Estimate("bbb"); got < 7 {
+		t.Fatalf("Estimate(bbb) = %d, want >= 7", got)
+	}
+	if a.Total() != 22 {
+		t.Fatalf("Total() = %d, want 22", a.Total())
+	}
+
+	if err := a.Merge(NewCountMinSketch(256, 5)); err != ErrDimensionMismatch {
+		t.Fatalf("err = %v, want %v", err, ErrDimensionMismatch)
+	}
+}
+
+func TestCountMinSketchMarshalBinary(t *testing.T) {
+	sketch := NewCountMinSketch(300, 3, WithConservativeUpdate())
+	for key, n := range zipfStream(10000) {
+		sketch.Add(key, n)
+	}
+
+	data, err := sketch.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &CountMinSketch{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Total() != sketch.Total() || !decoded.conservative {
+		t.Fatal("header fields were not restored")
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if decoded.Estimate(key) != sketch.Estimate(key) {
+			t.Fatalf("Estimate(%s) differs after decode", key)
+		}
+	}
+
+	data[4] = binaryVersion + 1
+	if err := decoded.UnmarshalBinary(data); err != ErrUnsupportedVersion {
+		t.Fatalf("err = %v, want %v", err, ErrUnsupportedVersion)
+	}
+	if err := decoded.UnmarshalBinary(data[:10]); err != ErrInvalidData {
+		t.Fatalf("err = %v, want %v", err, ErrInvalidData)
+	}
+
+	// A width and depth whose size in bytes wraps around to zero.
+	data[4] = binaryVersion
+	huge := append([]byte(nil), data[:headerSize]...)
+	binary.LittleEndian.PutUint32(huge[6:], 1<<31)
+	binary.LittleEndian.PutUint32(huge[10:], 1<<30)
+	if err := decoded.UnmarshalBinary(huge); err != ErrInvalidData {
+		t.Fatalf("huge sketch: err = %v, want %v", err, ErrInvalidData)
+	}
+}
@@ -0,0 +1,379 @@
+package cuckoo
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+
+	"github.com/Pangjiping/goutils/bloom"
+)
+
+// CuckooFilter is a space-efficient approximate membership filter that,
+// unlike a Bloom filter, supports deleting previously added values.
+//
+// Every value is reduced to a short fingerprint which is stored in one of
+// two candidate buckets. When both buckets are full an existing fingerprint
+// is kicked out to its alternate bucket, up to maxKicks times.
+type CuckooFilter struct {
+	// Packed fingerprint slots, fpBits bits per slot.
+	slots      []uint64
+	fpBits     uint
+	bucketSize uint
+	numBuckets uint64
+	maxKicks   uint
+	count      uint
+
+	// The fingerprint that could not be placed by the last kick-out loop.
+	// While it is set the filter refuses new values.
+	victim victimCache
+}
+
+type victimCache struct {
+	used  bool
+	index uint64
+	fp    uint32
+}
+
+const (
+	defaultCapacity   uint = 1024 * 1024
+	defaultFpBits     uint = 16
+	defaultBucketSize uint = 4
+	defaultMaxKicks   uint = 500
+
+	// The binary form stores the bucket size in a byte.
+	maxBucketSize uint = 255
+)
+
+// Option configures a CuckooFilter.
+type Option func(filter *CuckooFilter)
+
+// WithFingerprintBits sets the fingerprint size in bits, in the range [2, 32].
+// Longer fingerprints lower the false positive rate at the cost of space.
+func WithFingerprintBits(bits uint) Option {
+	return func(filter *CuckooFilter) {
+		if bits >= 2 && bits <= 32 {
+			filter.fpBits = bits
+		}
+	}
+}
+
+// WithBucketSize sets the number of fingerprint slots per bucket, in the
+// range [1, 255].
+func WithBucketSize(size uint) Option {
+	return func(filter *CuckooFilter) {
+		if size > 0 && size <= maxBucketSize {
+			filter.bucketSize = size
+		}
+	}
+}
+
+// WithMaxKicks bounds the number of relocations tried by a single Set.
+func WithMaxKicks(kicks uint) Option {
+	return func(filter *CuckooFilter) {
+		if kicks > 0 {
+			filter.maxKicks = kicks
+		}
+	}
+}
+
+// NewCuckooFilter returns a filter able to hold about capacity values.
+func NewCuckooFilter(capacity uint, opts ...Option) *CuckooFilter {
+	if capacity == 0 {
+		capacity = defaultCapacity
+	}
+
+	filter := &CuckooFilter{
+		fpBits:     defaultFpBits,
+		bucketSize: defaultBucketSize,
+		maxKicks:   defaultMaxKicks,
+	}
+	for _, opt := range opts {
+		opt(filter)
+	}
+
+	// The bucket count is a power of two so that the alternate index can be
+	// computed with a xor and stays within range in both directions.
+	buckets := uint64(1)
+	for buckets*uint64(filter.bucketSize) < uint64(capacity) {
+		buckets <<= 1
+	}
+	filter.numBuckets = buckets
+	filter.slots = make([]uint64, filter.wordCount())
+	return filter
+}
+
+// Set adds value to the filter, like Set of bloom.BloomFilter. A value that
+// does not fit because the filter is too full is dropped; use TrySet to find
+// out.
+func (filter *CuckooFilter) Set(value string) {
+	filter.TrySet(value)
+}
+
+// TrySet adds value to the filter. It returns false if the filter is too
+// full to take the value, in which case the filter is left unchanged.
+func (filter *CuckooFilter) TrySet(value string) bool {
+	if filter.victim.used {
+		return false
+	}
+
+	i1, fp := filter.indexAndFingerprint(value)
+	if filter.insertInto(i1, fp) {
+		filter.count++
+		return true
+	}
+	i2 := filter.altIndex(i1, fp)
+	if filter.insertInto(i2, fp) {
+		filter.count++
+		return true
+	}
+
+	index := i1
+	if rand.Intn(2) == 1 {
+		index = i2
+	}
+	for kick := uint(0); kick < filter.maxKicks; kick++ {
+		slot := uint(rand.Intn(int(filter.bucketSize)))
+		evicted := filter.slotAt(index, slot)
+		filter.setSlot(index, slot, fp)
+		fp = evicted
+		index = filter.altIndex(index, fp)
+		if filter.insertInto(index, fp) {
+			filter.count++
+			return true
+		}
+	}
+
+	// Keep the homeless fingerprint aside so no previously added value is
+	// lost; Check and Delete look at it as well.
+	filter.victim = victimCache{used: true, index: index, fp: fp}
+	filter.count++
+	return true
+}
+
+// Check reports whether value may have been added to the filter. A false
+// result is definite, a true result may be a false positive.
+func (filter *CuckooFilter) Check(value string) bool {
+	i1, fp := filter.indexAndFingerprint(value)
+	i2 := filter.altIndex(i1, fp)
+
+	if filter.victim.used && filter.victim.fp == fp &&
+		(filter.victim.index == i1 || filter.victim.index == i2) {
+		return true
+	}
+	return filter.bucketContains(i1, fp) || filter.bucketContains(i2, fp)
+}
+
+// Delete removes one occurrence of value from the filter and reports whether
+// it was found. Only values that were actually added may be deleted,
+// otherwise a colliding value could be removed instead.
+func (filter *CuckooFilter) Delete(value string) bool {
+	i1, fp := filter.indexAndFingerprint(value)
+	i2 := filter.altIndex(i1, fp)
+
+	if filter.deleteFrom(i1, fp) || filter.deleteFrom(i2, fp) {
+		filter.count--
+		filter.reinsertVictim()
+		return true
+	}
+
+	if filter.victim.used && filter.victim.fp == fp &&
+		(filter.victim.index == i1 || filter.victim.index == i2) {
+		filter.victim = victimCache{}
+		filter.count--
+		return true
+	}
+	return false
+}
+
+// Count returns the number of values currently held by the filter.
+func (filter *CuckooFilter) Count() uint {
+	return filter.count
+}
+
+// LoadFactor returns the fraction of occupied fingerprint slots.
+func (filter *CuckooFilter) LoadFactor() float64 {
+	return float64(filter.count) / float64(filter.numBuckets*uint64(filter.bucketSize))
+}
+
+// Reset removes every value from the filter.
+func (filter *CuckooFilter) Reset() {
+	for i := range filter.slots {
+		filter.slots[i] = 0
+	}
+	filter.count = 0
+	filter.victim = victimCache{}
+}
+
+func (filter *CuckooFilter) reinsertVictim() {
+	if !filter.victim.used {
+		return
+	}
+	victim := filter.victim
+	filter.victim = victimCache{}
+	if filter.insertInto(victim.index, victim.fp) ||
+		filter.insertInto(filter.altIndex(victim.index, victim.fp), victim.fp) {
+		return
+	}
+	filter.victim = victim
+}
+
+// indexAndFingerprint hashes with bloom.Hash64, which is 64-bit FNV-1a with
+// the murmur3 finalizer. Serialized filters depend on it, so another hash
+// would need a new binaryVersion.
+func (filter *CuckooFilter) indexAndFingerprint(value string) (uint64, uint32) {
+	hash := bloom.Hash64(value)
+
+	// Zero marks an empty slot, so it is never used as a fingerprint.
+	fp := uint32(hash>>32) & filter.fpMask()
+	if fp == 0 {
+		fp = 1
+	}
+	return hash & (filter.numBuckets - 1), fp
+}
+
+func (filter *CuckooFilter) altIndex(index uint64, fp uint32) uint64 {
+	return (index ^ (uint64(fp) * 0x5bd1e995)) & (filter.numBuckets - 1)
+}
+
+func (filter *CuckooFilter) insertInto(index uint64, fp uint32) bool {
+	for slot := uint(0); slot < filter.bucketSize; slot++ {
+		if filter.slotAt(index, slot) == 0 {
+			filter.setSlot(index, slot, fp)
+			return true
+		}
+	}
+	return false
+}
+
+func (filter *CuckooFilter) deleteFrom(index uint64, fp uint32) bool {
+	for slot := uint(0); slot < filter.bucketSize; slot++ {
+		if filter.slotAt(index, slot) == fp {
+			filter.setSlot(index, slot, 0)
+			return true
+		}
+	}
+	return false
+}
+
+func (filter *CuckooFilter) bucketContains(index uint64, fp uint32) bool {
+	for slot := uint(0); slot < filter.bucketSize; slot++ {
+		if filter.slotAt(index, slot) == fp {
+			return true
+		}
+	}
+	return false
+}
+
+func (filter *CuckooFilter) fpMask() uint32 {
+	return uint32(uint64(1)<<filter.fpBits - 1)
+}
+
+func (filter *CuckooFilter) wordCount() uint64 {
+	bits := filter.numBuckets * uint64(filter.bucketSize) * uint64(filter.fpBits)
+	return (bits + 63) / 64
+}
+
+func (filter *CuckooFilter) slotAt(index uint64, slot uint) uint32 {
+	off := (index*uint64(filter.bucketSize) + uint64(slot)) * uint64(filter.fpBits)
+	word, bit := off/64, off%64
+
+	val := filter.slots[word] >> bit
+	if bit+uint64(filter.fpBits) > 64 {
+		val |= filter.slots[word+1] << (64 - bit)
+	}
+	return uint32(val) & filter.fpMask()
+}
+
+func (filter *CuckooFilter) setSlot(index uint64, slot uint, fp uint32) {
+	off := (index*uint64(filter.bucketSize) + uint64(slot)) * uint64(filter.fpBits)
+	word, bit := off/64, off%64
+	mask := uint64(filter.fpMask())
+
+	filter.slots[word] = filter.slots[word]&^(mask<<bit) | uint64(fp)<<bit
+	if bit+uint64(filter.fpBits) > 64 {
+		shift := 64 - bit
+		filter.slots[word+1] = filter.slots[word+1]&^(mask>>shift) | uint64(fp)>>shift
+	}
+}
+
+const (
+	binaryMagic   = "CKOO"
+	binaryVersion = 1
+	headerSize    = 4 + 1 + 1 + 1 + 4 + 8 + 8 + 1 + 8 + 4
+)
+
+// ErrInvalidData is returned by UnmarshalBinary for malformed input.
+var ErrInvalidData = errors.New("cuckoo: invalid serialized filter")
+
+// MarshalBinary encodes the filter, including its configuration, into a
+// versioned little-endian binary form.
+func (filter *CuckooFilter) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, headerSize+8*len(filter.slots))
+	copy(buf, binaryMagic)
+	buf[4] = binaryVersion
+	buf[5] = byte(filter.fpBits)
+	buf[6] = byte(filter.bucketSize)
+	binary.LittleEndian.PutUint32(buf[7:], uint32(filter.maxKicks))
+	binary.LittleEndian.PutUint64(buf[11:], filter.numBuckets)
+	binary.LittleEndian.PutUint64(buf[19:], uint64(filter.count))
+	if filter.victim.used {
+		buf[27] = 1
+	}
+	binary.LittleEndian.PutUint64(buf[28:], filter.victim.index)
+	binary.LittleEndian.PutUint32(buf[36:], filter.victim.fp)
+
+	for i, word := range filter.slots {
+		binary.LittleEndian.PutUint64(buf[headerSize+8*i:], word)
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary replaces the filter with one decoded from data, which must
+// have been produced by MarshalBinary.
+func (filter *CuckooFilter) UnmarshalBinary(data []byte) error {
+	if len(data) < headerSize || string(data[:4]) != binaryMagic || data[4] != binaryVersion {
+		return ErrInvalidData
+	}
+
+	decoded := CuckooFilter{
+		fpBits:     uint(data[5]),
+		bucketSize: uint(data[6]),
+		maxKicks:   uint(binary.LittleEndian.Uint32(data[7:])),
+		numBuckets: binary.LittleEndian.Uint64(data[11:]),
+		count:      uint(binary.LittleEndian.Uint64(data[19:])),
+	}
+	if decoded.fpBits < 2 || decoded.fpBits > 32 || decoded.bucketSize == 0 ||
+		decoded.numBuckets == 0 || decoded.numBuckets&(decoded.numBuckets-1) != 0 {
+		return ErrInvalidData
+	}
+	// Bound the buckets by the body before wordCount multiplies them, so
+	// that a huge count cannot wrap around to a small one.
+	if decoded.numBuckets > uint64(len(data)-headerSize)*8/uint64(decoded.bucketSize*decoded.fpBits) {
+		return ErrInvalidData
+	}
+	if data[27] == 1 {
+		decoded.victim = victimCache{
+			used:  true,
+			index: binary.LittleEndian.Uint64(data[28:]),
+			fp:    binary.LittleEndian.Uint32(data[36:]),
+		}
+		if decoded.victim.index >= decoded.numBuckets ||
+			decoded.victim.fp == 0 || decoded.victim.fp > decoded.fpMask() {
+			return ErrInvalidData
+		}
+	} else if data[27] != 0 {
+		return ErrInvalidData
+	}
+
+	words := decoded.wordCount()
+	if uint64(len(data)-headerSize) != words*8 {
+		return ErrInvalidData
+	}
+	decoded.slots = make([]uint64, words)
+	for i := range decoded.slots {
+		decoded.slots[i] = binary.LittleEndian.Uint64(data[headerSize+8*i:])
+	}
+
+	*filter = decoded
+	return nil
+}
@@ -0,0 +1,184 @@
+package cuckoo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"testing"
+
+	"github.com/Pangjiping/goutils/bloom"
+)
+
+func TestCuckoo(t *testing.T) {
+	filter := NewCuckooFilter(1024)
+	filter.Set("aaa")
+	filter.Set("bbb")
+
+	if !filter.Check("aaa") || !filter.Check("bbb") {
+		t.Fatal("added values must be found")
+	}
+	if !filter.Delete("aaa") {
+		t.Fatal("delete of an added value must succeed")
+	}
+	if filter.Check("aaa") {
+		t.Log("false positive after delete: aaa")
+	}
+	if !filter.Check("bbb") {
+		t.Fatal("unrelated value lost after delete")
+	}
+	if filter.Count() != 1 {
+		t.Fatalf("count = %d, want 1", filter.Count())
+	}
+}
+
+func TestCuckooNoFalseNegatives(t *testing.T) {
+	filter := NewCuckooFilter(10000, WithFingerprintBits(12), WithBucketSize(4))
+	for i := 0; i < 9000; i++ {
+		if !filter.TrySet(fmt.Sprintf("%d", i)) {
+			t.Fatalf("filter full after %d values", i)
+		}
+	}
+	for i := 0; i < 9000; i++ {
+		if !filter.Check(fmt.Sprintf("%d", i)) {
+			t.Fatalf("false negative: %d", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 9000; i < 19000; i++ {
+		if filter.Check(fmt.Sprintf("%d", i)) {
+			falsePositives++
+		}
+	}
+	// Each lookup compares against the 2*4 slots of two buckets, so at most
+	// 8 in 2^12 absent values match by chance.
+	rate, bound := float64(falsePositives)/10000, 8.0/(1<<12)
+	if rate > bound {
+		t.Fatalf("false positive rate %.4f, want at most %.4f", rate, bound)
+	}
+	t.Logf("false positive rate: %.4f", rate)
+
+	for i := 0; i < 9000; i += 2 {
+		if !filter.Delete(fmt.Sprintf("%d", i)) {
+			t.Fatalf("delete failed: %d", i)
+		}
+	}
+	for i := 1; i < 9000; i += 2 {
+		if !filter.Check(fmt.Sprintf("%d", i)) {
+			t.Fatalf("false negative after deletes: %d", i)
+		}
+	}
+}
+
+func TestCuckooFull(t *testing.T) {
+	filter := NewCuckooFilter(64, WithBucketSize(2), WithMaxKicks(20))
+	added := make([]string, 0)
+	for i := 0; i < 1000; i++ {
+		value := fmt.Sprintf("v%d", i)
+		if !filter.TrySet(value) {
+			break
+		}
+		added = append(added, value)
+	}
+	if len(added) == 1000 {
+		t.Fatal("a 64 slot filter must eventually reject values")
+	}
+	for _, value := range added {
+		if !filter.Check(value) {
+			t.Fatalf("false negative in full filter: %s", value)
+		}
+	}
+}
+
+func TestCuckooMarshalBinary(t *testing.T) {
+	filter := NewCuckooFilter(4096, WithFingerprintBits(13), WithBucketSize(3))
+	for i := 0; i < 3000; i++ {
+		filter.Set(fmt.Sprintf("%d", i))
+	}
+
+	data, err := filter.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &CuckooFilter{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Count() != filter.Count() {
+		t.Fatalf("count = %d, want %d", decoded.Count(), filter.Count())
+	}
+	for i := 0; i < 3000; i++ {
+		if !decoded.Check(fmt.Sprintf("%d", i)) {
+			t.Fatalf("false negative after decode: %d", i)
+		}
+	}
+
+	if err := decoded.UnmarshalBinary(data[:len(data)-1]); err != ErrInvalidData {
+		t.Fatalf("truncated input: err = %v, want %v", err, ErrInvalidData)
+	}
+
+	// So many buckets that their size in words wraps around to zero.
+	huge := append([]byte(nil), data[:headerSize]...)
+	huge[5], huge[6], huge[27] = 16, 4, 0
+	binary.LittleEndian.PutUint64(huge[11:], 1<<62)
+	if err := decoded.UnmarshalBinary(huge); err != ErrInvalidData {
+		t.Fatalf("huge bucket count: err = %v, want %v", err, ErrInvalidData)
+	}
+
+	// A victim outside the buckets or wider than the fingerprints is
+	// rejected rather than trusted.
+	for _, victim := range []struct {
+		index uint64
+		fp    uint32
+	}{{4096, 1}, {1, 0}, {1, 1 << 13}} {
+		bad := append([]byte(nil), data...)
+		bad[27] = 1
+		binary.LittleEndian.PutUint64(bad[28:], victim.index)
+		binary.LittleEndian.PutUint32(bad[36:], victim.fp)
+		if err := decoded.UnmarshalBinary(bad); err != ErrInvalidData {
+			t.Fatalf("victim %v: err = %v, want %v", victim, err, ErrInvalidData)
+		}
+	}
+}
+
+func TestCuckooBucketSizeLimit(t *testing.T) {
+	// Bucket sizes above 255 do not fit the binary form and are ignored.
+	filter := NewCuckooFilter(1024, WithBucketSize(300))
+	if filter.bucketSize != defaultBucketSize {
+		t.Fatalf("bucket size = %d, want %d", filter.bucketSize, defaultBucketSize)
+	}
+	filter = NewCuckooFilter(1024, WithBucketSize(255))
+	filter.Set("aaa")
+	data, err := filter.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &CuckooFilter{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.bucketSize != 255 || !decoded.Check("aaa") {
+		t.Fatalf("bucket size = %d after decode", decoded.bucketSize)
+	}
+}
+
+// TestCuckooHashVersion checks that fingerprints and bucket indexes are still
+// those of the FNV-1a and murmur3 finalizer hash that version 1 filters were
+// serialized with.
+func TestCuckooHashVersion(t *testing.T) {
+	filter := NewCuckooFilter(4096, WithFingerprintBits(13))
+	for i := 0; i < 1000; i++ {
+		value := fmt.Sprintf("%d", i)
+		h := fnv.New64a()
+		h.Write([]byte(value))
+		hash := bloom.Mix64(h.Sum64())
+		fp := uint32(hash>>32) & filter.fpMask()
+		if fp == 0 {
+			fp = 1
+		}
+		index, got := filter.indexAndFingerprint(value)
+		if index != hash&(filter.numBuckets-1) || got != fp {
+			t.Fatalf("%q hashes to bucket %d, fingerprint %d, want %d, %d", value, index, got, hash&(filter.numBuckets-1), fp)
+		}
+	}
+}
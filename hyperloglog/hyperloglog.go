@@ -0,0 +1,354 @@
+package hyperloglog
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/Pangjiping/goutils/bloom"
+)
+
+// HyperLogLog estimates the number of distinct strings added to it, using
+// 2^precision one-byte registers at most.
+//
+// Like HyperLogLog++ it starts out in a sparse representation that records
+// the observed hashes at a precision of 25 bits, which is both smaller and
+// far more accurate than the registers while the cardinality is low, and
+// switches to the dense registers once that stops paying off. Dense counts
+// use Ertl's improved estimator, which is unbiased over the whole range
+// without the empirical bias tables of the original HyperLogLog++ paper.
+type HyperLogLog struct {
+	precision uint8
+
+	// Dense registers, nil while the sketch is sparse.
+	registers []uint8
+
+	// Sorted, deduplicated sparse entries and the unsorted entries added
+	// since the last merge into them.
+	sparse []uint32
+	tmp    []uint32
+}
+
+const (
+	minPrecision = 4
+	maxPrecision = 18
+
+	// Precision of the sparse representation.
+	sparsePrecision = 25
+)
+
+var (
+	// ErrPrecisionMismatch is returned when merging sketches of different precision.
+	ErrPrecisionMismatch = errors.New("hyperloglog: precisions do not match")
+
+	// ErrInvalidData is returned by UnmarshalBinary for malformed input.
+	ErrInvalidData = errors.New("hyperloglog: invalid serialized sketch")
+)
+
+// NewHyperLogLog returns an empty sketch with 2^precision registers. The
+// precision is clamped to [4, 18]; the standard error is 1.04/sqrt(2^precision),
+// about 0.8% at the common precision of 14.
+func NewHyperLogLog(precision uint8) *HyperLogLog {
+	if precision < minPrecision {
+		precision = minPrecision
+	} else if precision > maxPrecision {
+		precision = maxPrecision
+	}
+	return &HyperLogLog{precision: precision}
+}
+
+// Add records value, hashed with the same function as the bloom package.
+func (h *HyperLogLog) Add(value string) {
+	h.AddHash(bloom.Hash64(value))
+}
+
+// AddHash records a value by its uniformly distributed 64-bit hash.
+func (h *HyperLogLog) AddHash(hash uint64) {
+	if h.registers != nil {
+		index, rho := h.denseEntry(hash)
+		if rho > h.registers[index] {
+			h.registers[index] = rho
+		}
+		return
+	}
+
+	h.tmp = append(h.tmp, encodeSparse(hash))
+	if len(h.tmp) >= h.tmpLimit() {
+		h.mergeTmp()
+		if len(h.sparse) > h.sparseLimit() {
+			h.toDense()
+		}
+	}
+}
+
+// Count returns the estimated number of distinct values added.
+func (h *HyperLogLog) Count() uint64 {
+	if h.registers == nil {
+		h.mergeTmp()
+		// Linear counting over the 2^25 sparse buckets is nearly exact at
+		// the cardinalities where the sketch is still sparse.
+		m := float64(uint64(1) << sparsePrecision)
+		empty := m - float64(len(h.sparse))
+		return uint64(math.Round(m * math.Log(m/empty)))
+	}
+	return uint64(math.Round(h.estimateDense()))
+}
+
+// Merge adds every value recorded by other to the sketch. Both sketches
+// must have the same precision; other is not modified.
+func (h *HyperLogLog) Merge(other *HyperLogLog) error {
+	if h.precision != other.precision {
+		return ErrPrecisionMismatch
+	}
+
+	if h.registers == nil && other.registers == nil {
+		h.tmp = append(h.tmp, other.sparse...)
+		h.tmp = append(h.tmp, other.tmp...)
+		h.mergeTmp()
+		if len(h.sparse) > h.sparseLimit() {
+			h.toDense()
+		}
+		return nil
+	}
+
+	if h.registers == nil {
+		h.toDense()
+	}
+	if other.registers != nil {
+		for i, rho := range other.registers {
+			if rho > h.registers[i] {
+				h.registers[i] = rho
+			}
+		}
+		return nil
+	}
+	for _, list := range [][]uint32{other.sparse, other.tmp} {
+		for _, entry := range list {
+			index, rho := h.decodeSparse(entry)
+			if rho > h.registers[index] {
+				h.registers[index] = rho
+			}
+		}
+	}
+	return nil
+}
+
+// Precision returns the precision the sketch was created with.
+func (h *HyperLogLog) Precision() uint8 {
+	return h.precision
+}
+
+// Sparse reports whether the sketch still uses the sparse representation.
+func (h *HyperLogLog) Sparse() bool {
+	return h.registers == nil
+}
+
+func (h *HyperLogLog) denseEntry(hash uint64) (uint32, uint8) {
+	index := uint32(hash >> (64 - h.precision))
+	w := hash<<h.precision | 1<<(h.precision-1)
+	return index, uint8(bits.LeadingZeros64(w) + 1)
+}
+
+// A sparse entry packs the 25-bit bucket index above a 6-bit rank of the
+// remaining 39 hash bits.
+func encodeSparse(hash uint64) uint32 {
+	index := uint32(hash >> (64 - sparsePrecision))
+	w := hash<<sparsePrecision | 1<<(sparsePrecision-1)
+	rho := uint32(bits.LeadingZeros64(w) + 1)
+	return index<<6 | rho
+}
+
+// decodeSparse converts a sparse entry into the register index and value the
+// same hash would have produced in the dense representation.
+func (h *HyperLogLog) decodeSparse(entry uint32) (uint32, uint8) {
+	index := entry >> 6
+	rho := uint8(entry & 63)
+
+	shift := sparsePrecision - uint32(h.precision)
+	sub := index & (1<<shift - 1)
+	if sub != 0 {
+		return index >> shift, uint8(shift) - uint8(bits.Len32(sub)) + 1
+	}
+	return index >> shift, uint8(shift) + rho
+}
+
+func (h *HyperLogLog) tmpLimit() int {
+	limit := (1 << h.precision) / 16
+	if limit < 16 {
+		limit = 16
+	}
+	return limit
+}
+
+// sparseLimit is the entry count at which four bytes per sparse entry stop
+// being smaller than one byte per register.
+func (h *HyperLogLog) sparseLimit() int {
+	return (1 << h.precision) / 4
+}
+
+func (h *HyperLogLog) mergeTmp() {
+	if len(h.tmp) == 0 {
+		return
+	}
+
+	all := append(h.sparse, h.tmp...)
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+
+	// Entries sort by index, then rank, so keeping the last entry of each
+	// index keeps the highest rank.
+	merged := all[:0]
+	for i, entry := range all {
+		if i+1 < len(all) && all[i+1]>>6 == entry>>6 {
+			continue
+		}
+		merged = append(merged, entry)
+	}
+	h.sparse = merged
+	h.tmp = h.tmp[:0]
+}
+
+func (h *HyperLogLog) toDense() {
+	h.registers = make([]uint8, 1<<h.precision)
+	for _, list := range [][]uint32{h.sparse, h.tmp} {
+		for _, entry := range list {
+			index, rho := h.decodeSparse(entry)
+			if rho > h.registers[index] {
+				h.registers[index] = rho
+			}
+		}
+	}
+	h.sparse = nil
+	h.tmp = nil
+}
+
+// estimateDense implements the improved raw estimator from O. Ertl, "New
+// cardinality estimation algorithms for HyperLogLog sketches", 2017.
+func (h *HyperLogLog) estimateDense() float64 {
+	q := 64 - int(h.precision)
+	m := float64(len(h.registers))
+
+	histogram := make([]float64, q+2)
+	for _, rho := range h.registers {
+		histogram[rho]++
+	}
+
+	z := m * tau(1-histogram[q+1]/m)
+	for k := q; k >= 1; k-- {
+		z = 0.5 * (z + histogram[k])
+	}
+	z += m * sigma(histogram[0]/m)
+	return m * m / (2 * math.Ln2 * z)
+}
+
+func sigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if z == prev {
+			return z
+		}
+	}
+}
+
+func tau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if z == prev {
+			return z / 3
+		}
+	}
+}
+
+// The serialized form is a header followed by either the sorted sparse
+// entries or the dense registers:
+//
+//	magic "HLLP" | version u8 | precision u8 | dense u8 | sparse count u32
+const (
+	binaryMagic   = "HLLP"
+	binaryVersion = 1
+	headerSize    = 4 + 1 + 1 + 1 + 4
+)
+
+// MarshalBinary encodes the sketch into its versioned binary form.
+func (h *HyperLogLog) MarshalBinary() ([]byte, error) {
+	h.mergeTmp()
+
+	var buf []byte
+	if h.registers != nil {
+		buf = make([]byte, headerSize+len(h.registers))
+		buf[6] = 1
+		copy(buf[headerSize:], h.registers)
+	} else {
+		buf = make([]byte, headerSize+4*len(h.sparse))
+		binary.LittleEndian.PutUint32(buf[7:], uint32(len(h.sparse)))
+		for i, entry := range h.sparse {
+			binary.LittleEndian.PutUint32(buf[headerSize+4*i:], entry)
+		}
+	}
+	copy(buf, binaryMagic)
+	buf[4] = binaryVersion
+	buf[5] = h.precision
+	return buf, nil
+}
+
+// UnmarshalBinary replaces the sketch with one decoded from data.
+func (h *HyperLogLog) UnmarshalBinary(data []byte) error {
+	if len(data) < headerSize || string(data[:4]) != binaryMagic || data[4] != binaryVersion {
+		return ErrInvalidData
+	}
+	precision := data[5]
+	if precision < minPrecision || precision > maxPrecision {
+		return ErrInvalidData
+	}
+
+	decoded := HyperLogLog{precision: precision}
+	body := data[headerSize:]
+	if data[6] == 1 {
+		if len(body) != 1<<precision {
+			return ErrInvalidData
+		}
+		decoded.registers = make([]uint8, len(body))
+		copy(decoded.registers, body)
+		for _, rho := range decoded.registers {
+			if int(rho) > 65-int(precision) {
+				return ErrInvalidData
+			}
+		}
+	} else {
+		n := binary.LittleEndian.Uint32(data[7:])
+		if uint64(len(body)) != 4*uint64(n) {
+			return ErrInvalidData
+		}
+		decoded.sparse = make([]uint32, n)
+		for i := range decoded.sparse {
+			entry := binary.LittleEndian.Uint32(body[4*i:])
+			if i > 0 && entry>>6 <= decoded.sparse[i-1]>>6 {
+				return ErrInvalidData
+			}
+			// encodeSparse ranks the 64-25 bits below the index, and the
+			// index itself has 25 bits.
+			if rho := entry & 63; rho < 1 || rho > 64-sparsePrecision+1 || entry>>6 >= 1<<sparsePrecision {
+				return ErrInvalidData
+			}
+			decoded.sparse[i] = entry
+		}
+	}
+
+	*h = decoded
+	return nil
+}
@@ -0,0 +1,141 @@
+package hyperloglog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func relativeError(got uint64, want int) float64 {
+	return math.Abs(float64(got)-float64(want)) / float64(want)
+}
+
+func TestHyperLogLog(t *testing.T) {
+	hll := NewHyperLogLog(14)
+	hll.Add("aaa")
+	hll.Add("bbb")
+	hll.Add("aaa")
+
+	if got := hll.Count(); got != 2 {
+		t.Fatalf("Count() = %d, want 2", got)
+	}
+	if !hll.Sparse() {
+		t.Fatal("a sketch with two values must still be sparse")
+	}
+}
+
+func TestHyperLogLogAccuracy(t *testing.T) {
+	tests := []struct {
+		n      int
+		maxErr float64
+	}{
+		{n: 100, maxErr: 0.001},
+		{n: 3000, maxErr: 0.005},
+		{n: 50000, maxErr: 0.03},
+		{n: 1000000, maxErr: 0.03},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d", tt.n), func(t *testing.T) {
+			hll := NewHyperLogLog(14)
+			for i := 0; i < tt.n; i++ {
+				hll.Add(fmt.Sprintf("value%d", i))
+			}
+			got := hll.Count()
+			t.Logf("n=%d estimate=%d sparse=%v", tt.n, got, hll.Sparse())
+			if err := relativeError(got, tt.n); err > tt.maxErr {
+				t.Fatalf("Count() = %d, relative error %.4f above %.4f", got, err, tt.maxErr)
+			}
+		})
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	tests := []struct {
+		name   string
+		na, nb int
+	}{
+		{name: "SparseSparse", na: 500, nb: 500},
+		{name: "DenseSparse", na: 100000, nb: 500},
+		{name: "SparseDense", na: 500, nb: 100000},
+		{name: "DenseDense", na: 100000, nb: 100000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := NewHyperLogLog(12), NewHyperLogLog(12)
+			for i := 0; i < tt.na; i++ {
+				a.Add(fmt.Sprintf("a%d", i))
+			}
+			// Half of b overlaps with a.
+			for i := 0; i < tt.nb; i++ {
+				if i%2 == 0 {
+					b.Add(fmt.Sprintf("a%d", i))
+				} else {
+					b.Add(fmt.Sprintf("b%d", i))
+				}
+			}
+
+			if err := a.Merge(b); err != nil {
+				t.Fatal(err)
+			}
+			want := tt.na + tt.nb/2
+			if tt.nb > tt.na {
+				want = tt.nb + (tt.na+1)/2
+			}
+			if err := relativeError(a.Count(), want); err > 0.05 {
+				t.Fatalf("Count() = %d after merge, want about %d", a.Count(), want)
+			}
+		})
+	}
+
+	if err := NewHyperLogLog(12).Merge(NewHyperLogLog(14)); err != ErrPrecisionMismatch {
+		t.Fatalf("err = %v, want %v", err, ErrPrecisionMismatch)
+	}
+}
+
+func TestHyperLogLogMarshalBinary(t *testing.T) {
+	for _, n := range []int{1000, 100000} {
+		hll := NewHyperLogLog(14)
+		for i := 0; i < n; i++ {
+			hll.Add(fmt.Sprintf("value%d", i))
+		}
+
+		data, err := hll.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := &HyperLogLog{}
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Count() != hll.Count() || decoded.Sparse() != hll.Sparse() {
+			t.Fatalf("n=%d: decoded sketch differs", n)
+		}
+		if err := decoded.UnmarshalBinary(data[:len(data)-1]); err != ErrInvalidData {
+			t.Fatalf("err = %v, want %v", err, ErrInvalidData)
+		}
+	}
+}
+
+func TestHyperLogLogUnmarshalBadSparse(t *testing.T) {
+	hll := NewHyperLogLog(14)
+	hll.Add("a")
+	data, err := hll.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := binary.LittleEndian.Uint32(data[headerSize:]) >> 6
+	for _, entry := range []uint32{index << 6, index<<6 | 41, index<<6 | 63, 1<<31 | 1} {
+		binary.LittleEndian.PutUint32(data[headerSize:], entry)
+		decoded := &HyperLogLog{}
+		if err := decoded.UnmarshalBinary(data); err != ErrInvalidData {
+			t.Fatalf("entry %#x: err = %v, want %v", entry, err, ErrInvalidData)
+		}
+	}
+	binary.LittleEndian.PutUint32(data[headerSize:], index<<6|40)
+	if err := (&HyperLogLog{}).UnmarshalBinary(data); err != nil {
+		t.Fatalf("largest rank: %v", err)
+	}
+}
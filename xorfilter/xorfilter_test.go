@@ -0,0 +1,119 @@
+package xorfilter
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Pangjiping/goutils/bloom"
+)
+
+func TestXorFilter(t *testing.T) {
+	filter, err := Populate([]string{"aaa", "bbb", "aaa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filter.Check("aaa") || !filter.Check("bbb") {
+		t.Fatal("keys of the set must be found")
+	}
+	t.Log(filter.Check("ccc"))
+
+	empty, err := Populate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(empty.Check("aaa"))
+
+	var zero XorFilter
+	if zero.Check("aaa") {
+		t.Fatal("a zero XorFilter must be empty")
+	}
+}
+
+func TestXorFilterFalsePositives(t *testing.T) {
+	const n = 100000
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+	}
+	filter, err := Populate(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if !filter.Check(key) {
+			t.Fatalf("false negative: %s", key)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < n; i++ {
+		if filter.Check(fmt.Sprintf("other%d", i)) {
+			falsePositives++
+		}
+	}
+	rate := float64(falsePositives) / n
+	t.Logf("%.2f bits/key, false positive rate %.4f", float64(8*filter.Size())/n, rate)
+	if rate > 0.006 {
+		t.Fatalf("false positive rate %.4f, want about 1/256", rate)
+	}
+}
+
+func TestXorFilterMarshalBinary(t *testing.T) {
+	keys := make([]string, 5000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+	}
+	filter, err := Populate(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := filter.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &XorFilter{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if !decoded.Check(key) {
+			t.Fatalf("false negative after decode: %s", key)
+		}
+	}
+	if err := decoded.UnmarshalBinary(data[:len(data)-1]); err != ErrInvalidData {
+		t.Fatalf("err = %v, want %v", err, ErrInvalidData)
+	}
+}
+
+func benchKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%016x", bloom.Hash64(fmt.Sprintf("%d", i)))
+	}
+	return keys
+}
+
+func BenchmarkXorFilterCheck(b *testing.B) {
+	keys := benchKeys(1 << 20)
+	filter, err := Populate(keys[:len(keys)/2])
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		filter.Check(keys[i&(len(keys)-1)])
+	}
+}
+
+func BenchmarkBloomFilterCheck(b *testing.B) {
+	keys := benchKeys(1 << 20)
+	filter := bloom.NewBloomFilter(uint(len(keys) / 2 * 10))
+	for _, key := range keys[:len(keys)/2] {
+		filter.Set(key)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		filter.Check(keys[i&(len(keys)-1)])
+	}
+}